@@ -0,0 +1,321 @@
+/*
+	peer 之间交换拥有的块
+	1. bitfield: 已完成的块的位图，每个块一位，高位在前，base64 编码
+	2. have: 长轮询获取指定序号之后完成的块，序号过期时重新获取 bitfield
+*/
+
+package nodeserv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/blueskyz/uvdt/logger"
+	"github.com/blueskyz/uvdt/node-serv/setting"
+)
+
+/*
+ * have 通知
+ */
+const (
+	HAVE_LOG_SIZE       = 1024    // 保留最近完成的块数量，超过时 peer 需要重新获取 bitfield
+	HAVE_POLL_TIMEOUT   = 30      // 长轮询最长等待时间，单位秒
+	PEER_SYNC_INTERVAL  = 10      // 检查需要同步的 peer 的间隔，单位秒
+	PEER_SYNC_BACKOFF   = 30      // 同步失败后重试的间隔，单位秒
+	PEER_SYNC_MAX_BYTES = 1 << 20 // bitfield 和 have 响应的最大长度
+)
+
+// 请求 peer bitfield 和 have 的 http client，等待时间大于长轮询时间
+var peerSyncClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   PEER_DIAL_TIMEOUT * time.Second,
+			KeepAlive: 30 * time.Second}).DialContext,
+		ResponseHeaderTimeout: (HAVE_POLL_TIMEOUT + PEER_RESPONSE_TIMEOUT) * time.Second,
+		IdleConnTimeout:       90 * time.Second}}
+
+// 最近完成的块，序号从 1 开始
+type HaveLog struct {
+	lock   sync.Mutex
+	seq    int64     // 最新的序号
+	blocks []int     // 最近完成的块，最后一个的序号为 seq
+	notify chan bool // 有新的块完成时关闭并重新创建
+}
+
+func NewHaveLog() *HaveLog {
+	return &HaveLog{notify: make(chan bool)}
+}
+
+/*
+ * 记录完成的块，通知等待的请求
+ */
+func (hl *HaveLog) Add(index int) {
+	hl.lock.Lock()
+	defer hl.lock.Unlock()
+
+	hl.seq++
+	hl.blocks = append(hl.blocks, index)
+	if len(hl.blocks) > HAVE_LOG_SIZE {
+		hl.blocks = hl.blocks[len(hl.blocks)-HAVE_LOG_SIZE:]
+	}
+	close(hl.notify)
+	hl.notify = make(chan bool)
+}
+
+func (hl *HaveLog) Seq() int64 {
+	hl.lock.Lock()
+	defer hl.lock.Unlock()
+
+	return hl.seq
+}
+
+/*
+ * 序号 since 之后完成的块，返回最新的序号
+ * since 已经过期或者大于最新的序号（任务重新开始）时 ok 为 false，需要重新获取 bitfield
+ */
+func (hl *HaveLog) Since(since int64) ([]int, int64, bool) {
+	hl.lock.Lock()
+	defer hl.lock.Unlock()
+
+	oldest := hl.seq - int64(len(hl.blocks))
+	if since < oldest || since > hl.seq {
+		return nil, hl.seq, false
+	}
+	blocks := make([]int, hl.seq-since)
+	copy(blocks, hl.blocks[int64(len(hl.blocks))-(hl.seq-since):])
+	return blocks, hl.seq, true
+}
+
+/*
+ * 等待序号 since 之后完成的块，超时返回空列表
+ */
+func (hl *HaveLog) Wait(ctx context.Context, since int64, timeout time.Duration) ([]int, int64, bool) {
+	hl.lock.Lock()
+	notify := hl.notify
+	hl.lock.Unlock()
+
+	blocks, seq, ok := hl.Since(since)
+	if !ok || len(blocks) > 0 {
+		return blocks, seq, ok
+	}
+	select {
+	case <-notify:
+	case <-time.After(timeout):
+	case <-ctx.Done():
+	}
+	return hl.Since(since)
+}
+
+/*
+ * 块状态编码为位图，高位在前
+ */
+func encodeBitfield(blocks []BlockMeta) []byte {
+	bits := make([]byte, (len(blocks)+7)/8)
+	for i, block := range blocks {
+		if block.blockStat == BS_COMPLETE {
+			bits[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return bits
+}
+
+/*
+ * 解码位图，返回每个块是否拥有
+ */
+func decodeBitfield(bits []byte, blockCount int) ([]bool, error) {
+	if len(bits) != (blockCount+7)/8 {
+		return nil, errors.New(fmt.Sprintf("bitfield length err, expect: %d, got: %d",
+			(blockCount+7)/8,
+			len(bits)))
+	}
+	have := make([]bool, blockCount)
+	for i := range have {
+		have[i] = bits[i/8]&(0x80>>uint(i%8)) != 0
+	}
+	return have, nil
+}
+
+/*
+ * 已完成块的位图和当前的 have 序号，任务没有开始时返回 ErrBlockNotFound
+ */
+func (ftMgr *FileTasksMgr) GetBitfield() ([]byte, int, int64, error) {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	if ftMgr.haves == nil || (ftMgr.stat != FM_DOWNLOAD && ftMgr.stat != FM_SHARE) {
+		return nil, 0, 0, ErrBlockNotFound
+	}
+	// 在锁内读取序号，保证位图包含序号之前完成的所有块
+	return encodeBitfield(ftMgr.fileMeta.blocks), len(ftMgr.fileMeta.blocks), ftMgr.haves.Seq(), nil
+}
+
+func (ftMgr *FileTasksMgr) getHaveLog() *HaveLog {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.haves
+}
+
+/*
+ * 从 peer 的 bt 服务获取 json 结果
+ */
+func getPeerResult(ctx context.Context, url string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := peerSyncClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("http status: %d", resp.StatusCode))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, PEER_SYNC_MAX_BYTES))
+	if err != nil {
+		return nil, err
+	}
+	servResult := make(map[string]interface{})
+	if err := json.Unmarshal(data, &servResult); err != nil {
+		return nil, err
+	}
+	if status, ok := servResult["status"].(float64); !ok || status != 0 {
+		return nil, errors.New(fmt.Sprintf("status error, %v", servResult["msg"]))
+	}
+	result, ok := servResult["result"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("result error")
+	}
+	return result, nil
+}
+
+/*
+ * 获取 peer 的 bitfield，更新 peer 拥有的块，返回 have 序号
+ */
+func (ftMgr *FileTasksMgr) syncBitfield(ctx context.Context, peerId string, addr string) (int64, error) {
+	url := fmt.Sprintf("http://%s/api/resource/bitfield?infohash=%s&peer_id=%s",
+		addr,
+		ftMgr.fileMeta.fileMd5,
+		setting.AppSetting.GetPeerId())
+	result, err := getPeerResult(ctx, url)
+	if err != nil {
+		return 0, err
+	}
+
+	value, _ := result["bitfield"].(string)
+	bits, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return 0, err
+	}
+	have, err := decodeBitfield(bits, ftMgr.fileMeta.blockCount)
+	if err != nil {
+		return 0, err
+	}
+	seq, _ := result["seq"].(float64)
+	ftMgr.peers.SetBitfield(peerId, have)
+
+	// peer 提供 wire 服务时使用 wire 下载
+	if port, ok := result["wire_port"].(float64); ok && port > 0 {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			ftMgr.peers.SetWireAddr(peerId, net.JoinHostPort(host, fmt.Sprintf("%d", int(port))))
+		}
+	}
+	return int64(seq), nil
+}
+
+/*
+ * 长轮询 peer 新完成的块，返回新的序号，序号过期时 reset 为 true
+ */
+func (ftMgr *FileTasksMgr) syncHaves(ctx context.Context,
+	peerId string,
+	addr string,
+	since int64) (int64, bool, error) {
+
+	url := fmt.Sprintf("http://%s/api/resource/have?infohash=%s&peer_id=%s&since=%d&timeout=%d",
+		addr,
+		ftMgr.fileMeta.fileMd5,
+		setting.AppSetting.GetPeerId(),
+		since,
+		HAVE_POLL_TIMEOUT)
+	result, err := getPeerResult(ctx, url)
+	if err != nil {
+		return since, false, err
+	}
+	if reset, _ := result["reset"].(bool); reset {
+		return since, true, nil
+	}
+
+	blocks, _ := result["blocks"].([]interface{})
+	for _, v := range blocks {
+		if index, ok := v.(float64); ok {
+			ftMgr.peers.SetBlock(peerId, int(index), PB_HAVE)
+		}
+	}
+	seq, _ := result["seq"].(float64)
+	return int64(seq), false, nil
+}
+
+/*
+ * 同步一个 peer 拥有的块，先获取 bitfield，再长轮询新完成的块
+ * peer 从列表中删除或者 ctx 取消时退出，出错时退出，由 peerSyncLoop 稍后重试
+ */
+func (ftMgr *FileTasksMgr) syncPeer(ctx context.Context, peerId string, addr string) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	defer ftMgr.peers.EndSync(peerId)
+
+	seq, err := ftMgr.syncBitfield(ctx, peerId, addr)
+	for err == nil && ctx.Err() == nil && ftMgr.peers.Has(peerId) {
+		var reset bool
+		seq, reset, err = ftMgr.syncHaves(ctx, peerId, addr, seq)
+		if err == nil && reset {
+			seq, err = ftMgr.syncBitfield(ctx, peerId, addr)
+		}
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Err(fmt.Sprintf("Sync peer %s[%s] of %s fail, %s",
+			peerId,
+			addr,
+			ftMgr.fileMeta.fileMd5,
+			err.Error()))
+	}
+}
+
+/*
+ * 下载中定时检查 peer 列表，为没有同步的 peer 开始同步
+ */
+func (ftMgr *FileTasksMgr) peerSyncLoop(stop chan bool) {
+	ftMgr.lock.RLock()
+	ctx, cancel := context.WithCancel(ftMgr.ctx)
+	peers := ftMgr.peers
+	ftMgr.lock.RUnlock()
+	defer cancel()
+
+	for {
+		if !ftMgr.IsDownloading() {
+			return
+		}
+		for peerId, addr := range peers.BeginSync(time.Now()) {
+			go ftMgr.syncPeer(ctx, peerId, addr)
+		}
+
+		select {
+		case <-time.After(PEER_SYNC_INTERVAL * time.Second):
+		case _ = <-stop:
+			return
+		}
+	}
+}
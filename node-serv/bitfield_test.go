@@ -0,0 +1,66 @@
+package nodeserv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHaveLogSince(t *testing.T) {
+	small := NewHaveLog()
+	for _, index := range []int{5, 3, 8} {
+		small.Add(index)
+	}
+	full := NewHaveLog()
+	for i := 0; i < HAVE_LOG_SIZE+10; i++ {
+		full.Add(i)
+	}
+
+	cases := []struct {
+		haves  *HaveLog
+		since  int64
+		blocks []int
+		seq    int64
+		ok     bool
+	}{
+		{NewHaveLog(), 0, []int{}, 0, true},
+		{small, 0, []int{5, 3, 8}, 3, true},
+		{small, 1, []int{3, 8}, 3, true},
+		{small, 3, []int{}, 3, true},
+		{small, 4, nil, 3, false}, // 任务重新开始后序号变小
+		{full, HAVE_LOG_SIZE + 8, []int{HAVE_LOG_SIZE + 8, HAVE_LOG_SIZE + 9}, HAVE_LOG_SIZE + 10, true},
+		{full, 10, full.blocks, HAVE_LOG_SIZE + 10, true}, // 最早保留的序号
+		{full, 9, nil, HAVE_LOG_SIZE + 10, false},         // 已经过期
+	}
+	for i, c := range cases {
+		blocks, seq, ok := c.haves.Since(c.since)
+		if ok != c.ok || seq != c.seq || !reflect.DeepEqual(blocks, c.blocks) {
+			t.Errorf("case %d: Since(%d) = %d blocks, %d, %v, want %d blocks, %d, %v",
+				i, c.since, len(blocks), seq, ok, len(c.blocks), c.seq, c.ok)
+		}
+	}
+}
+
+func TestBitfield(t *testing.T) {
+	blocks := make([]BlockMeta, 10)
+	for _, i := range []int{0, 7, 8, 9} {
+		blocks[i].blockStat = BS_COMPLETE
+	}
+	blocks[3].blockStat = BS_DOWNLOADING
+
+	bits := encodeBitfield(blocks)
+	if !reflect.DeepEqual(bits, []byte{0x81, 0xc0}) {
+		t.Fatalf("encodeBitfield = %x, want 81c0", bits)
+	}
+	have, err := decodeBitfield(bits, len(blocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range blocks {
+		if have[i] != (blocks[i].blockStat == BS_COMPLETE) {
+			t.Errorf("block %d have: %v", i, have[i])
+		}
+	}
+	if _, err := decodeBitfield(bits, 17); err == nil {
+		t.Errorf("decodeBitfield accepts length mismatch")
+	}
+}
@@ -4,14 +4,18 @@
 package nodeserv
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/blueskyz/uvdt/logger"
 	"github.com/blueskyz/uvdt/node-serv/setting"
@@ -38,6 +42,16 @@ func BtHttpServ(filesManager *FilesManager) error {
 	// 提供文件分片下载服务
 	HttpBtServMux.HandleFunc("/api/resource/download", httpBtDownloadHandler)
 
+	// 向 peer 提供已下载完成的数据块
+	HttpBtServMux.HandleFunc("/api/resource/block", httpBtBlockHandler)
+
+	// 已完成块的位图，长轮询新完成的块
+	HttpBtServMux.HandleFunc("/api/resource/bitfield", httpBtBitfieldHandler)
+	HttpBtServMux.HandleFunc("/api/resource/have", httpBtHaveHandler)
+
+	// 交换 peer 列表
+	HttpBtServMux.HandleFunc("/api/resource/pex", httpBtPexHandler)
+
 	httpBtServ := setting.AppSetting.GetBtServ()
 	log.Info(fmt.Sprintf("%s:%d", httpBtServ.Ip, httpBtServ.Port))
 	err := http.ListenAndServe(fmt.Sprintf("%s:%d",
@@ -87,6 +101,12 @@ func httpBtDownloadHandler(w http.ResponseWriter, r *http.Request) {
 		utils.CreateErrResp(w, &log, "downloadpath is empty")
 		return
 	}
+	// 多文件种子选择下载的文件
+	sel, err := parseFileSelection(values)
+	if err != nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("File selection err, %s", err.Error()))
+		return
+	}
 
 	// 1. 下载 torrent file
 	peerId := setting.AppSetting.GetPeerId()
@@ -147,7 +167,7 @@ func httpBtDownloadHandler(w http.ResponseWriter, r *http.Request) {
 
 	// 2. 从 share 目录找到共享的文件
 	//	  创建本地共享文件
-	_, infohash, err := btFilesMgr.CreateDownloadTask(destDownloadPath, []byte(torrent))
+	_, infohash, err := btFilesMgr.CreateDownloadTask(destDownloadPath, []byte(torrent), sel)
 	if err != nil {
 		log.Err(fmt.Sprintf("%s: %s", infoHash, err.Error()))
 		utils.CreateErrResp(w,
@@ -264,3 +284,225 @@ func httpShareResourceHandler(w http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{}
 	utils.CreateSuccResp(w, &log, "Create share file task succ.", result)
 }
+
+/*
+ * 提供数据块
+ * /api/resource/block?infohash=xxx&index=0&peer_id=xxx
+ * Range: bytes=a-b 为块内的区间，没有时返回整个块
+ *
+ * 200/206: 数据，X-Block-Md5 为整个块的 md5
+ * 404: 任务不存在，或者块没有下载完成
+ * 416: 区间错误
+ * 503: 暂停上传，上传位置已满，或者内存不足，Retry-After 之后重试
+ */
+func httpBtBlockHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	values := r.URL.Query()
+	infoHash := values.Get("infohash")
+	peerId := values.Get("peer_id")
+	index, err := strconv.Atoi(values.Get("index"))
+	if err != nil {
+		http.Error(w, "index err", http.StatusBadRequest)
+		return
+	}
+
+	if btFilesMgr.IsUploadPaused() {
+		w.Header().Set("Retry-After", strconv.Itoa(TIME_SCHEDULE_INTERVAL))
+		http.Error(w, "upload paused", http.StatusServiceUnavailable)
+		return
+	}
+	ftMgr := btFilesMgr.GetTask(infoHash)
+	if ftMgr == nil {
+		http.Error(w, "task not exist", http.StatusNotFound)
+		return
+	}
+	blockLength, blockMd5, err := ftMgr.GetBlockInfo(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	offset, length, partial, err := parseBlockRange(r.Header.Get("Range"), blockLength)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", blockLength))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	// 没有 peer_id 时按来源地址区分 peer
+	if peerId == "" {
+		peerId, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	if !ftMgr.RequestUpload(peerId) {
+		w.Header().Set("Retry-After", strconv.Itoa(CHOKE_INTERVAL))
+		http.Error(w, "upload slots full", http.StatusServiceUnavailable)
+		return
+	}
+
+	data, release, err := ftMgr.ReadBlock(index, offset, length)
+	switch err {
+	case nil:
+	case ErrBlockNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case ErrInvalidRange:
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	case ErrUploadBusy:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		log.Err(fmt.Sprintf("Read block %s[%d] fail, %s", infoHash, index, err.Error()))
+		http.Error(w, "read block fail", http.StatusInternalServerError)
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(length))
+	w.Header().Set("X-Block-Md5", blockMd5)
+	if partial {
+		w.Header().Set("Content-Range",
+			fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, blockLength))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// 上传限速，发送中断时只统计已发送的数据
+	writer := newRateLimitedWriter(r.Context(), w, ftMgr.uploadLimiters()...)
+	n, err := writer.Write(data)
+	ftMgr.AddUpload(int64(n))
+	if err != nil {
+		log.Err(fmt.Sprintf("Send block %s[%d] to %s fail, %s", infoHash, index, peerId, err.Error()))
+		return
+	}
+	log.Info(fmt.Sprintf("Send block %s[%d] to %s, range: %d-%d",
+		infoHash,
+		index,
+		peerId,
+		offset,
+		offset+length-1))
+}
+
+/*
+ * 已完成块的位图
+ * /api/resource/bitfield?infohash=xxx&peer_id=xxx
+ * {"block_count": 10, "bitfield": "base64", "seq": 5, "wire_port": 8090}
+ * seq 用于长轮询新完成的块，wire_port 为 0 时没有 wire 服务
+ */
+func httpBtBitfieldHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	infoHash := r.URL.Query().Get("infohash")
+	ftMgr := btFilesMgr.GetTask(infoHash)
+	if ftMgr == nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Task not exist, %s", infoHash))
+		return
+	}
+	bits, blockCount, seq, err := ftMgr.GetBitfield()
+	if err != nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Get bitfield fail, %s, %s", infoHash, err.Error()))
+		return
+	}
+	utils.CreateSuccResp(w,
+		&log,
+		fmt.Sprintf("Bitfield %s to %s, seq: %d", infoHash, r.URL.Query().Get("peer_id"), seq),
+		map[string]interface{}{
+			"block_count": blockCount,
+			"bitfield":    base64.StdEncoding.EncodeToString(bits),
+			"seq":         seq,
+			"wire_port":   setting.AppSetting.GetWireServ().Port,
+		})
+}
+
+/*
+ * 长轮询序号 since 之后完成的块，没有时最多等待 timeout 秒
+ * /api/resource/have?infohash=xxx&peer_id=xxx&since=5&timeout=30
+ * {"seq": 7, "blocks": [3, 8]}，序号过期时返回 {"reset": true}，需要重新获取 bitfield
+ */
+func httpBtHaveHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	values := r.URL.Query()
+	infoHash := values.Get("infohash")
+	since, err := strconv.ParseInt(values.Get("since"), 10, 64)
+	if err != nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("since err, %s", values.Get("since")))
+		return
+	}
+	timeout := HAVE_POLL_TIMEOUT
+	if v, err := strconv.Atoi(values.Get("timeout")); err == nil && v >= 0 && v < timeout {
+		timeout = v
+	}
+
+	ftMgr := btFilesMgr.GetTask(infoHash)
+	if ftMgr == nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Task not exist, %s", infoHash))
+		return
+	}
+	haves := ftMgr.getHaveLog()
+	if haves == nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Task not started, %s", infoHash))
+		return
+	}
+
+	blocks, seq, ok := haves.Wait(r.Context(), since, time.Duration(timeout)*time.Second)
+	if !ok {
+		utils.CreateSuccResp(w,
+			&log,
+			fmt.Sprintf("Have %s reset, since: %d, seq: %d", infoHash, since, seq),
+			map[string]interface{}{"reset": true, "seq": seq})
+		return
+	}
+	utils.CreateSuccResp(w,
+		&log,
+		fmt.Sprintf("Have %s, since: %d, seq: %d, blocks: %d", infoHash, since, seq, len(blocks)),
+		map[string]interface{}{"seq": seq, "blocks": blocks})
+}
+
+/*
+ * 交换 peer 列表，请求方加入本节点的 peer 列表
+ * /api/resource/pex?infohash=xxx&peer_id=xxx&port=8089
+ * {"peers": ["peer_id:ip:port"]}
+ */
+func httpBtPexHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	values := r.URL.Query()
+	infoHash := values.Get("infohash")
+	peerId := values.Get("peer_id")
+	if peerId == "" || strings.Contains(peerId, ":") {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("peer_id err, %s", peerId))
+		return
+	}
+
+	// 请求方的 bt 服务地址，端口错误时只返回列表
+	// peer 格式为 peer_id:ip:port，不支持 ipv6 地址
+	addr := ""
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if port, perr := strconv.Atoi(values.Get("port")); err == nil && perr == nil &&
+		port > 0 && port < 65536 && !strings.Contains(ip, ":") {
+		addr = fmt.Sprintf("%s:%d", ip, port)
+	}
+
+	ftMgr := btFilesMgr.GetTask(infoHash)
+	if ftMgr == nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Task not exist, %s", infoHash))
+		return
+	}
+	peerList, err := ftMgr.ExchangePeers(peerId, addr)
+	if err != nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Exchange peers fail, %s, %s", infoHash, err.Error()))
+		return
+	}
+	utils.CreateSuccResp(w,
+		&log,
+		fmt.Sprintf("Exchange peers %s with %s[%s], peers: %d", infoHash, peerId, addr, len(peerList)),
+		map[string]interface{}{"peers": peerList})
+}
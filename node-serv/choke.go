@@ -0,0 +1,274 @@
+/*
+	上传位置管理，限制每个任务和整个节点同时上传的 peer 数量
+	1. 有空闲位置时请求的 peer 直接获得上传位置（unchoke）
+	2. 没有空闲位置时拒绝请求，返回 503 和 Retry-After，peer 等待后重试
+	3. 定时轮换上传位置，优先给同时也向本节点上传数据的 peer，
+	   保留一个乐观位置轮流分给其他等待的 peer，保证新的 peer 可以开始下载
+*/
+
+package nodeserv
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blueskyz/uvdt/logger"
+)
+
+/*
+ * 上传位置轮换
+ */
+const (
+	CHOKE_INTERVAL      = 10 // 轮换间隔，单位秒，也是拒绝请求的 Retry-After
+	UPLOAD_IDLE_TIMEOUT = 30 // peer 超过该时间没有请求时释放上传位置，单位秒
+)
+
+// 节点的上传位置
+type UploadSlots struct {
+	lock  sync.Mutex
+	limit int // 上传位置数量，0: 不限制
+	used  int
+}
+
+var nodeUploadSlots = &UploadSlots{}
+
+func (us *UploadSlots) SetLimit(limit int) {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	us.limit = limit
+}
+
+func (us *UploadSlots) TryAcquire() bool {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	if us.limit > 0 && us.used >= us.limit {
+		return false
+	}
+	us.used++
+	return true
+}
+
+func (us *UploadSlots) Release() {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	if us.used > 0 {
+		us.used--
+	}
+}
+
+func (us *UploadSlots) Usage() (int, int) {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	return us.used, us.limit
+}
+
+// 任务的上传位置
+type Choker struct {
+	lock       sync.Mutex
+	slots      int                  // 上传位置数量，0: 不限制
+	unchoked   map[string]time.Time // 获得上传位置的 peer -> 最后请求时间
+	interested map[string]time.Time // 被拒绝等待上传位置的 peer -> 最后请求时间
+	optimistic string               // 乐观上传位置的 peer
+	refused    int64                // 拒绝的请求数量
+}
+
+func NewChoker(slots int) *Choker {
+	return &Choker{slots: slots,
+		unchoked:   make(map[string]time.Time),
+		interested: make(map[string]time.Time)}
+}
+
+/*
+ * peer 请求上传，已经有上传位置或者有空闲位置时返回 true
+ */
+func (ch *Choker) Request(peerId string) bool {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	now := time.Now()
+	if _, ok := ch.unchoked[peerId]; ok {
+		ch.unchoked[peerId] = now
+		return true
+	}
+	if (ch.slots == 0 || len(ch.unchoked) < ch.slots) && nodeUploadSlots.TryAcquire() {
+		delete(ch.interested, peerId)
+		ch.unchoked[peerId] = now
+		return true
+	}
+	ch.interested[peerId] = now
+	ch.refused++
+	return false
+}
+
+/*
+ * 轮换上传位置
+ * 1. 释放超时没有请求的 peer 的上传位置
+ * 2. 按 reciprocity（peer 向本节点上传的速度）从高到低分配 slots - 1 个位置
+ * 3. 剩下的一个位置随机分给其他 peer，与上一次的乐观 peer 不同
+ */
+func (ch *Choker) Rotate(reciprocity func(peerId string) float64) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	now := time.Now()
+	candidates := []string{}
+	for peerId, lasttime := range ch.unchoked {
+		if now.Sub(lasttime) > UPLOAD_IDLE_TIMEOUT*time.Second {
+			delete(ch.unchoked, peerId)
+			nodeUploadSlots.Release()
+			continue
+		}
+		candidates = append(candidates, peerId)
+	}
+	for peerId, lasttime := range ch.interested {
+		if now.Sub(lasttime) > UPLOAD_IDLE_TIMEOUT*time.Second {
+			delete(ch.interested, peerId)
+			continue
+		}
+		candidates = append(candidates, peerId)
+	}
+	if ch.slots == 0 || len(candidates) <= ch.slots {
+		return
+	}
+
+	// 1. 按 reciprocity 排序，相同时随机
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	rates := make(map[string]float64)
+	for _, peerId := range candidates {
+		rates[peerId] = reciprocity(peerId)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rates[candidates[i]] > rates[candidates[j]]
+	})
+
+	// 2. 乐观位置
+	selected := make(map[string]bool)
+	for _, peerId := range candidates[:ch.slots-1] {
+		selected[peerId] = true
+	}
+	others := []string{}
+	for _, peerId := range candidates[ch.slots-1:] {
+		if peerId != ch.optimistic {
+			others = append(others, peerId)
+		}
+	}
+	if len(others) > 0 {
+		ch.optimistic = others[rand.Intn(len(others))]
+		selected[ch.optimistic] = true
+	}
+
+	// 3. 更新上传位置，节点的上传位置不足时等待下一次轮换
+	for peerId, lasttime := range ch.unchoked {
+		if !selected[peerId] {
+			delete(ch.unchoked, peerId)
+			ch.interested[peerId] = lasttime
+			nodeUploadSlots.Release()
+		}
+	}
+	for peerId := range selected {
+		if _, ok := ch.unchoked[peerId]; ok {
+			continue
+		}
+		if !nodeUploadSlots.TryAcquire() {
+			break
+		}
+		ch.unchoked[peerId] = ch.interested[peerId]
+		delete(ch.interested, peerId)
+	}
+}
+
+/*
+ * 任务停止时释放所有上传位置
+ */
+func (ch *Choker) Close() {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	for peerId := range ch.unchoked {
+		delete(ch.unchoked, peerId)
+		nodeUploadSlots.Release()
+	}
+	ch.interested = make(map[string]time.Time)
+}
+
+/*
+ * 上传位置统计
+ */
+func (ch *Choker) Stats() map[string]interface{} {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	unchoked := []string{}
+	for peerId := range ch.unchoked {
+		unchoked = append(unchoked, peerId)
+	}
+	return map[string]interface{}{
+		"slots":      ch.slots,
+		"unchoked":   unchoked,
+		"interested": len(ch.interested),
+		"optimistic": ch.optimistic,
+		"refused":    ch.refused,
+	}
+}
+
+/*
+ * peer 请求上传，任务没有开始时不限制
+ */
+func (ftMgr *FileTasksMgr) RequestUpload(peerId string) bool {
+	ftMgr.lock.RLock()
+	choker := ftMgr.choker
+	ftMgr.lock.RUnlock()
+
+	if choker == nil {
+		return true
+	}
+	return choker.Request(peerId)
+}
+
+/*
+ * 轮换任务的上传位置，优先给向本节点上传速度快的 peer
+ */
+func (ftMgr *FileTasksMgr) rotateUploads() {
+	ftMgr.lock.RLock()
+	choker := ftMgr.choker
+	peers := ftMgr.peers
+	ftMgr.lock.RUnlock()
+
+	if choker == nil || peers == nil {
+		return
+	}
+	choker.Rotate(peers.Reciprocity)
+}
+
+/*
+ * 定时轮换所有任务的上传位置
+ */
+func (filesMgr *FilesManager) chokeLoop() {
+	for {
+		time.Sleep(CHOKE_INTERVAL * time.Second)
+
+		filesMgr.lock.RLock()
+		tasks := filesMgr.fileTasksMgr
+		filesMgr.lock.RUnlock()
+
+		for _, v := range tasks {
+			v.rotateUploads()
+		}
+
+		used, limit := nodeUploadSlots.Usage()
+		if limit > 0 && used >= limit {
+			log := logger.NewAgent()
+			log.Info(fmt.Sprintf("Node upload slots full, used: %d, limit: %d", used, limit))
+			log.EndLog()
+		}
+	}
+}
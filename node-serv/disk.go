@@ -0,0 +1,78 @@
+/*
+	磁盘空间检查和文件预分配
+*/
+
+package nodeserv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+/*
+ * 磁盘空间
+ * 1. 创建下载任务时检查剩余空间并预分配文件，保留一部分空间给系统
+ * 2. 写入数据时磁盘已满，暂停下载任务，剩余空间足够后恢复
+ */
+const (
+	DISK_RESERVE = 64 << 20 // 保留的磁盘空间，单位：字节
+)
+
+// 磁盘空间不足
+var ErrNoSpace = errors.New("no space left on device")
+
+/*
+ * 判断错误是否为磁盘空间不足
+ */
+func isNoSpace(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC || err == ErrNoSpace
+}
+
+/*
+ * 检查目录所在的文件系统是否有 size 字节的剩余空间
+ * 无法获取剩余空间时不做限制
+ */
+func checkFreeSpace(dir string, size int64) error {
+	free, err := diskFree(dir)
+	if err != nil {
+		return nil
+	}
+	if size+DISK_RESERVE > int64(free) {
+		return errors.New(fmt.Sprintf("%s, need: %d, free: %d", ErrNoSpace.Error(), size, free))
+	}
+	return nil
+}
+
+/*
+ * 预分配文件，已存在的数据不变
+ * 文件系统不支持预分配时扩展为稀疏文件
+ */
+func preallocate(file string, size int64) error {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= size {
+		return nil
+	}
+	if err := fallocate(f, size); err == nil {
+		return nil
+	} else if isNoSpace(err) {
+		return err
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,24 @@
+package nodeserv
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+ * 目录所在文件系统的剩余空间，单位：字节
+ */
+func diskFree(dir string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
+
+/*
+ * 为文件分配磁盘空间
+ */
+func fallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, 0, size)
+}
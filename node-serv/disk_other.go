@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package nodeserv
+
+import (
+	"errors"
+	"os"
+)
+
+/*
+ * 不支持获取剩余空间
+ */
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.New("disk free not supported")
+}
+
+/*
+ * 不支持预分配，由调用方扩展为稀疏文件
+ */
+func fallocate(f *os.File, size int64) error {
+	return errors.New("fallocate not supported")
+}
@@ -3,3 +3,143 @@
 */
 
 package nodeserv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blueskyz/uvdt/node-serv/setting"
+)
+
+// peer 没有请求的数据块
+var ErrBlockNotFound = errors.New("block not found")
+
+// peer 拒绝上传，等待 retryAfter 后重试
+type PeerBusyError struct {
+	retryAfter time.Duration
+}
+
+func (e *PeerBusyError) Error() string {
+	return fmt.Sprintf("peer busy, retry after %v", e.retryAfter)
+}
+
+/*
+ * peer 请求超时，单位秒
+ * 数据传输受限速影响，时间不固定，不设置总超时，由 worker 的下载阻塞检查处理
+ */
+const (
+	PEER_DIAL_TIMEOUT     = 10 // 连接超时
+	PEER_RESPONSE_TIMEOUT = 30 // 等待响应头超时
+)
+
+// 请求 peer 数据块的 http client
+var peerClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   PEER_DIAL_TIMEOUT * time.Second,
+			KeepAlive: 30 * time.Second}).DialContext,
+		ResponseHeaderTimeout: PEER_RESPONSE_TIMEOUT * time.Second,
+		MaxIdleConnsPerHost:   SUB_BLOCK_PIPELINE,
+		IdleConnTimeout:       90 * time.Second}}
+
+/*
+ * 解析 tracker 返回的 peer 信息: peer_id:ip:port
+ */
+func parsePeer(peer string) (string, string, error) {
+	items := strings.Split(peer, ":")
+	if len(items) != 3 {
+		return "", "", errors.New(fmt.Sprintf("peer format err, %s", peer))
+	}
+	return items[0], fmt.Sprintf("%s:%s", items[1], items[2]), nil
+}
+
+/*
+ * 从 peer 的 bt 服务下载数据块的指定区间，ctx 取消时中断请求，limiters 限制下载速度
+ * progress 记录下载进度，可以为空
+ *
+ * index:  块序号
+ * offset: 块内偏移
+ * length: 数据长度
+ */
+func downloadFromPeer(ctx context.Context,
+	addr string,
+	infoHash string,
+	index int,
+	offset uint,
+	length uint,
+	progress transferProgress,
+	limiters ...*RateLimiter) ([]byte, error) {
+
+	url := fmt.Sprintf("http://%s/api/resource/block?infohash=%s&index=%d&peer_id=%s",
+		addr,
+		infoHash,
+		index,
+		setting.AppSetting.GetPeerId())
+	return downloadRange(ctx, url, offset, length, progress, limiters...)
+}
+
+/*
+ * 下载 url 的指定区间，ctx 取消时中断请求，limiters 限制下载速度
+ * 每次读取数据和等待限速时更新 progress，限速的慢速下载不会被当作阻塞
+ * 服务器不支持 range 返回整个文件时，只接受从 0 开始的区间
+ */
+func downloadRange(ctx context.Context,
+	url string,
+	offset uint,
+	length uint,
+	progress transferProgress,
+	limiters ...*RateLimiter) ([]byte, error) {
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBlockNotFound
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter := CHOKE_INTERVAL
+		if v, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && v > 0 {
+			retryAfter = v
+		}
+		return nil, &PeerBusyError{retryAfter: time.Duration(retryAfter) * time.Second}
+	}
+	if resp.StatusCode == http.StatusOK && offset != 0 {
+		return nil, errors.New("range not supported")
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.New(fmt.Sprintf("http status: %d", resp.StatusCode))
+	}
+
+	// 最多读取 length + 1 字节，用来判断 peer 返回的数据是否过长
+	body := newRateLimitedReader(ctx, resp.Body, progress, limiters...)
+	data, err := ioutil.ReadAll(io.LimitReader(body, int64(length)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint(len(data)) != length {
+		return nil, errors.New(fmt.Sprintf("data length err, expect: %d, got: %d",
+			length,
+			len(data)))
+	}
+
+	return data, nil
+}
@@ -0,0 +1,230 @@
+/*
+	多文件种子的文件映射，所有文件按顺序连接成一个数据流，块可以跨越文件边界
+*/
+
+package nodeserv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * 种子内容类型
+ */
+const (
+	CT_SINGLEFILE = "singlefile"
+	CT_MULTIFILE  = "multifile"
+)
+
+// 多文件种子中的文件
+type FileEntry struct {
+	path   string // 相对于种子目录的路径
+	size   int64  // 文件大小
+	offset int64  // 在数据流中的偏移
+
+	priority int // 下载优先级，FP_SKIP: 不下载
+}
+
+// 数据区间对应的文件片段
+type fileSpan struct {
+	file   string // 文件路径，本地文件为绝对路径，web seed 为 url 路径
+	offset int64  // 文件内偏移
+	start  int    // 在数据区间中的偏移
+	length int    // 长度
+}
+
+/*
+ * 解析种子的文件列表: [{"path": "a/b.txt", "size": 1024}]
+ * 文件路径必须是种子目录下的相对路径，不能重复也不能互为目录，文件大小之和必须等于 file_size
+ */
+func parseFileEntries(files []interface{}, fileSize int64) ([]FileEntry, error) {
+	entries := []FileEntry{}
+	offset := int64(0)
+	for _, v := range files {
+		item, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("files format err")
+		}
+		filePath, ok := item["path"].(string)
+		if !ok {
+			return nil, errors.New("file path format err")
+		}
+		size, ok := item["size"].(float64)
+		if !ok || size < 0 {
+			return nil, errors.New(fmt.Sprintf("file size err, %s", filePath))
+		}
+
+		cleanPath := path.Clean(filePath)
+		if len(filePath) == 0 || path.IsAbs(cleanPath) || cleanPath == "." ||
+			cleanPath == ".." || strings.HasPrefix(cleanPath, "../") {
+			return nil, errors.New(fmt.Sprintf("file path err, %s", filePath))
+		}
+		// 路径不能重复，也不能是其他文件的目录
+		for _, entry := range entries {
+			if entry.path == cleanPath ||
+				strings.HasPrefix(entry.path, cleanPath+"/") ||
+				strings.HasPrefix(cleanPath, entry.path+"/") {
+				return nil, errors.New(fmt.Sprintf("file path conflict, %s, %s", entry.path, filePath))
+			}
+		}
+
+		entries = append(entries, FileEntry{path: cleanPath, size: int64(size), offset: offset})
+		offset += int64(size)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("files is empty")
+	}
+	if offset != fileSize {
+		return nil, errors.New(fmt.Sprintf("files size err, expect: %d, got: %d", fileSize, offset))
+	}
+	return entries, nil
+}
+
+/*
+ * 从种子或元数据中加载文件列表，单文件种子只有一个文件
+ */
+func (fileMeta *FileMeta) loadFiles(content map[string]interface{}) error {
+	if fileMeta.contenttype == CT_SINGLEFILE {
+		fileMeta.files = nil
+		return nil
+	}
+	if fileMeta.contenttype != CT_MULTIFILE {
+		return errors.New(fmt.Sprintf("content type err, %s", fileMeta.contenttype))
+	}
+
+	files, ok := content["files"].([]interface{})
+	if !ok {
+		return errors.New("multifile without files")
+	}
+	entries, err := parseFileEntries(files, int64(fileMeta.fileSize))
+	if err != nil {
+		return err
+	}
+	fileMeta.files = entries
+	return nil
+}
+
+/*
+ * 文件列表和文件的下载优先级，保存到元数据
+ */
+func (fileMeta *FileMeta) dumpFiles() []map[string]interface{} {
+	files := []map[string]interface{}{}
+	for _, v := range fileMeta.files {
+		files = append(files, map[string]interface{}{"path": v.path, "size": v.size, "priority": v.priority})
+	}
+	return files
+}
+
+/*
+ * 数据流中的所有文件，单文件种子返回数据文件
+ */
+func (fileMeta *FileMeta) dataFiles() []FileEntry {
+	if fileMeta.contenttype != CT_MULTIFILE {
+		return []FileEntry{{path: fileMeta.GetDataFile(), size: int64(fileMeta.fileSize)}}
+	}
+
+	root := fileMeta.GetDataFile()
+	files := []FileEntry{}
+	for _, v := range fileMeta.files {
+		files = append(files, FileEntry{path: filepath.Join(root, filepath.FromSlash(v.path)),
+			size:     v.size,
+			offset:   v.offset,
+			priority: v.priority})
+	}
+	return files
+}
+
+/*
+ * 把数据流的区间 [pos, pos+length) 映射到本地文件片段
+ */
+func (fileMeta *FileMeta) spans(pos int64, length int) []fileSpan {
+	return mapSpans(fileMeta.dataFiles(), pos, length)
+}
+
+/*
+ * 把数据流的区间 [pos, pos+length) 映射到文件片段，files 按数据流中的偏移排序
+ */
+func mapSpans(files []FileEntry, pos int64, length int) []fileSpan {
+	spans := []fileSpan{}
+	end := pos + int64(length)
+	for _, v := range files {
+		if v.offset+v.size <= pos || v.size == 0 {
+			continue
+		}
+		if v.offset >= end {
+			break
+		}
+		begin := pos
+		if v.offset > begin {
+			begin = v.offset
+		}
+		stop := end
+		if v.offset+v.size < stop {
+			stop = v.offset + v.size
+		}
+		spans = append(spans, fileSpan{file: v.path,
+			offset: begin - v.offset,
+			start:  int(begin - pos),
+			length: int(stop - begin)})
+	}
+	return spans
+}
+
+/*
+ * 本地文件的大小和最后修改时间，文件不存在时大小为 -1
+ */
+func (fileMeta *FileMeta) localFiles() (map[string]int64, time.Time, error) {
+	sizes := make(map[string]int64)
+	modTime := time.Time{}
+	for _, v := range fileMeta.dataFiles() {
+		fi, err := os.Stat(v.path)
+		if os.IsNotExist(err) {
+			sizes[v.path] = -1
+			continue
+		} else if err != nil {
+			return nil, modTime, err
+		}
+		sizes[v.path] = fi.Size()
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return sizes, modTime, nil
+}
+
+/*
+ * 本地文件是否包含数据流的区间 [pos, pos+length)
+ */
+func (fileMeta *FileMeta) hasData(sizes map[string]int64, pos int64, length int) bool {
+	for _, v := range fileMeta.spans(pos, length) {
+		if sizes[v.file] < v.offset+int64(v.length) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * 按顺序读取所有文件的数据
+ */
+func (fileMeta *FileMeta) copyData(w io.Writer) error {
+	for _, v := range fileMeta.dataFiles() {
+		f, err := os.Open(v.path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, io.LimitReader(f, v.size))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package nodeserv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMapSpans(t *testing.T) {
+	files := []FileEntry{
+		{path: "a", size: 100, offset: 0},
+		{path: "empty", size: 0, offset: 100},
+		{path: "b", size: 50, offset: 100},
+		{path: "c", size: 200, offset: 150},
+	}
+	cases := []struct {
+		pos    int64
+		length int
+		want   []fileSpan
+	}{
+		// 在一个文件内
+		{10, 20, []fileSpan{{file: "a", offset: 10, start: 0, length: 20}}},
+		// 跨越文件边界，跳过空文件
+		{90, 20, []fileSpan{
+			{file: "a", offset: 90, start: 0, length: 10},
+			{file: "b", offset: 0, start: 10, length: 10}}},
+		// 跨越多个文件
+		{90, 100, []fileSpan{
+			{file: "a", offset: 90, start: 0, length: 10},
+			{file: "b", offset: 0, start: 10, length: 50},
+			{file: "c", offset: 0, start: 60, length: 40}}},
+		// 从文件开头开始
+		{150, 10, []fileSpan{{file: "c", offset: 0, start: 0, length: 10}}},
+		// 超出文件末尾的部分被忽略
+		{300, 100, []fileSpan{{file: "c", offset: 150, start: 0, length: 50}}},
+		{350, 10, []fileSpan{}},
+	}
+	for _, c := range cases {
+		got := mapSpans(files, c.pos, c.length)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("mapSpans(%d, %d) = %+v, want %+v", c.pos, c.length, got, c.want)
+		}
+	}
+}
+
+func TestParseFileEntries(t *testing.T) {
+	cases := []struct {
+		paths []string
+		ok    bool
+	}{
+		{[]string{"a", "b/c", "b/d"}, true},
+		{[]string{"a", "ab/c"}, true},
+		{[]string{"."}, false},
+		{[]string{"a/.."}, false},
+		{[]string{"../a"}, false},
+		{[]string{"/a"}, false},
+		{[]string{"a", "./a"}, false}, // 重复
+		{[]string{"a", "a/b"}, false}, // a 既是文件又是目录
+		{[]string{"a/b/c", "a/b"}, false},
+	}
+	for _, c := range cases {
+		files := []interface{}{}
+		for _, v := range c.paths {
+			files = append(files, map[string]interface{}{"path": v, "size": float64(1)})
+		}
+		_, err := parseFileEntries(files, int64(len(c.paths)))
+		if (err == nil) != c.ok {
+			t.Errorf("parseFileEntries(%v) err: %v, want ok: %v", c.paths, err, c.ok)
+		}
+	}
+}
@@ -5,15 +5,17 @@
 package nodeserv
 
 import (
+	"context"
+	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -34,11 +36,28 @@ const (
 /*
  * 上传，下载文件管理
  */
+// 块下载失败次数达到上限后，暂停下载的时间，单位秒
+const (
+	BLOCK_MAX_FAIL_COUNT = 10
+	BLOCK_FAIL_BACKOFF   = 60
+)
+
+// endgame 阶段同一个块最多同时请求的 peer 数量
+const ENDGAME_MAX_REQUESTS = 3
+
+// 子块大小，同时请求的子块数量，每个子块的重试次数
+const (
+	SUB_BLOCK_SIZE     = 256 << 10
+	SUB_BLOCK_PIPELINE = 4
+	SUB_BLOCK_RETRY    = 3
+)
+
 type BlockMeta struct {
 	blockMd5  string // 每个分片的 md5
 	blockStat uint   // 0: 未下载，1: 已完成, 2: 下载中，3: 下载失败
 	failCount uint   // 每分钟失败次数，无法下载，当大于等于10次，下1分钟内不下载此块
 	lasttime  int    // 最后下载时间
+	priority  int    // 下载优先级，由文件的下载优先级计算，FP_SKIP: 不下载
 }
 
 /*
@@ -56,6 +75,25 @@ const (
 	FM_SHARE
 )
 
+// tracker 没有返回间隔时间或报告失败时，默认的报告间隔，单位秒
+const ANNOUNCE_INTERVAL = 30
+
+// 请求 tracker 的超时时间，单位秒
+const TRACKER_TIMEOUT = 30
+
+var trackerClient = &http.Client{Timeout: TRACKER_TIMEOUT * time.Second}
+
+/*
+ * 下载阻塞检查，单位秒
+ * worker 超过 WORKER_STALL_TIMEOUT 没有开始新的请求也没有收到数据时，取消正在进行的请求，
+ * 等待限速的时间不算阻塞，
+ * 块重新放回队列，提供数据的 peer 记录出错
+ */
+const (
+	WORKER_STALL_TIMEOUT = 120
+	WATCHDOG_INTERVAL    = 10
+)
+
 type FileMeta struct {
 	version     string
 	contenttype string // singlefile, multifile
@@ -72,6 +110,9 @@ type FileMeta struct {
 	blockCount   int    // 块数量
 	blockSize    int    // 每块大小
 	blocks       []BlockMeta
+	files        []FileEntry // 多文件种子的文件列表，fileDlPath/filename 为种子目录
+	priority     int         // 排队下载的优先级，数值大的先开始
+	webSeeds     []string    // web seed 地址，没有 peer 时从源服务器下载
 }
 
 /*
@@ -100,6 +141,10 @@ func (fileMeta *FileMeta) SaveMetaFile(md5 string) error {
 	meta["file_dl_path"] = fileMeta.fileDlPath
 	meta["file_name"] = fileMeta.filename
 	meta["file_md5"] = fileMeta.fileMd5
+	meta["priority"] = fileMeta.priority
+	if len(fileMeta.webSeeds) > 0 {
+		meta["web_seeds"] = fileMeta.webSeeds
+	}
 
 	meta["file_size"] = fileMeta.fileSize
 	if fileMeta.fileSize <= 0 {
@@ -113,6 +158,9 @@ func (fileMeta *FileMeta) SaveMetaFile(md5 string) error {
 	if fileMeta.blockSize <= 0 {
 		return errors.New(fmt.Sprintf("block size is %d", fileMeta.fileSize))
 	}
+	if fileMeta.contenttype == CT_MULTIFILE {
+		meta["files"] = fileMeta.dumpFiles()
+	}
 
 	blocksStat := []map[string]interface{}{}
 	for _, v := range fileMeta.blocks {
@@ -131,14 +179,21 @@ func (fileMeta *FileMeta) SaveMetaFile(md5 string) error {
 		return err
 	}
 
-	f, err := os.OpenFile(fileMeta.fileMetaName, os.O_RDWR|os.O_CREATE, 0644)
-	defer f.Close()
+	// 先写入临时文件再替换，避免写入过程中退出损坏元数据文件
+	tmpMetaName := fileMeta.fileMetaName + ".tmp"
+	f, err := os.OpenFile(tmpMetaName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	f.Write(metaData)
+	if _, err := f.Write(metaData); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
 
-	return nil
+	return os.Rename(tmpMetaName, fileMeta.fileMetaName)
 }
 
 /*
@@ -167,13 +222,11 @@ func (fileMeta *FileMeta) LoadMetaFile(md5 string) error {
 	}
 	defer f.Close()
 
-	metaData := make([]byte, 1024<<10)
-	count, err := f.Read(metaData)
-	if err != nil && err != io.EOF {
+	metaData, err := ioutil.ReadAll(f)
+	if err != nil {
 		log.Err(fmt.Sprintf("Read meta data fail, %s", jsonMetaFile))
 		return err
 	}
-	metaData = metaData[:count]
 
 	// 4. 解析元数据
 	meta := make(map[string]interface{})
@@ -190,10 +243,19 @@ func (fileMeta *FileMeta) LoadMetaFile(md5 string) error {
 	fileMeta.fileDlPath = meta["file_dl_path"].(string)
 	fileMeta.filename = meta["file_name"].(string)
 	fileMeta.fileMd5 = meta["file_md5"].(string)
+	if priority, ok := meta["priority"].(float64); ok {
+		fileMeta.priority = int(priority)
+	}
 
 	fileMeta.fileSize = int(meta["file_size"].(float64))
 	fileMeta.blockCount = int(meta["block_count"].(float64))
 	fileMeta.blockSize = int(meta["block_size"].(float64))
+	if err := fileMeta.loadFiles(meta); err != nil {
+		log.Err(fmt.Sprintf("Load files fail, %s, %s", jsonMetaFile, err.Error()))
+		return err
+	}
+	fileMeta.loadFilePriorities(meta)
+	fileMeta.loadWebSeeds(meta)
 
 	blocks := []BlockMeta{}
 	for _, v := range meta["blocks"].([]interface{}) {
@@ -208,48 +270,147 @@ func (fileMeta *FileMeta) LoadMetaFile(md5 string) error {
 		blocks = append(blocks, blockMeta)
 	}
 	fileMeta.blocks = blocks
+	fileMeta.updateBlockPriorities()
+
+	return nil
+}
+
+/*
+ * 下载/共享文件的绝对路径，多文件种子为种子目录
+ */
+func (fileMeta *FileMeta) GetDataFile() string {
+	return path.Join(fileMeta.fileDlPath, fileMeta.filename)
+}
+
+/*
+ * 按数据流位置写入数据，多文件种子的数据可能写入多个文件
+ */
+func (fileMeta *FileMeta) WriteAt(data []byte, pos int64) error {
+	for _, v := range fileMeta.spans(pos, len(data)) {
+		if err := os.MkdirAll(filepath.Dir(v.file), os.ModeDir|os.ModePerm); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(v.file, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(data[v.start:v.start+v.length], v.offset); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+/*
+ * 按数据流位置读取数据，多文件种子的数据可能来自多个文件
+ */
+func (fileMeta *FileMeta) ReadAt(data []byte, pos int64) error {
+	return readSpans(fileMeta.spans(pos, len(data)), data)
+}
+
+/*
+ * 读取文件片段到 data
+ */
+func readSpans(spans []fileSpan, data []byte) error {
+	for _, v := range spans {
+		f, err := os.Open(v.file)
+		if err != nil {
+			return err
+		}
+		_, err = f.ReadAt(data[v.start:v.start+v.length], v.offset)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// 块的下载请求，endgame 阶段同一个块会同时向多个 peer 请求
+type blockFlight struct {
+	lock   sync.Mutex
+	ctx    context.Context // 块下载完成后取消其他请求
+	cancel context.CancelFunc
+	count  int             // 未返回的请求数量，由控制协程维护
+	peers  map[string]bool // 已经请求过的 peer
+}
+
+/*
+ * 选择一个可以提供块数据的 peer
+ * 优先选择没有请求过该块的 peer，都请求过时选择除 failed 以外的 peer
+ */
+func (flight *blockFlight) pickPeer(peers *Peers, index int, failed map[string]bool) (Peer, error) {
+	flight.lock.Lock()
+	defer flight.lock.Unlock()
+
+	exclude := make(map[string]bool)
+	for peerId := range flight.peers {
+		exclude[peerId] = true
+	}
+	for peerId := range failed {
+		exclude[peerId] = true
+	}
+	peer, err := peers.Pick(index, exclude)
+	if err != nil {
+		peer, err = peers.Pick(index, failed)
+		if err != nil {
+			return peer, err
+		}
+	}
+	flight.peers[peer.peerId] = true
+	return peer, nil
+}
+
 // 下载任务结构
 type JobData struct {
-	pos    uint // 文件内位置
-	length uint // 数据长度
+	index  int          // 块序号
+	pos    uint         // 文件内位置
+	length uint         // 数据长度
+	single bool         // 只从一个 peer 下载，块校验失败后重新下载时使用，便于定位提供错误数据的 peer
+	flight *blockFlight // 块的下载请求
 }
 
 // 下载数据结构
 type BlockData struct {
-	workId int    // 执行下载任务的工作协程id
-	pos    uint   // 文件内位置
-	length uint   // 数据长度
-	data   []byte // 下载的数据内容
-	isErr  int    // 0: 成功，1: 失败
-}
-
-// peer 地址列表
-type Peers struct {
-	addr   string // ip:port
-	weight int    // 下载权重，-1: 不可用，0: 可用，>0 可用性增大 （需要换成优先队列）
+	workId  int      // 执行下载任务的工作协程id
+	index   int      // 块序号
+	pos     uint     // 文件内位置
+	length  uint     // 数据长度
+	data    []byte   // 下载的数据内容
+	peerIds []string // 提供数据的 peer id
+	isErr   int      // 0: 成功，1: 失败
 }
 
 // worker 定义执行具体的下载工作
 type Worker struct {
-	id       int
-	infoHash string // 文件 hash id
-	filePath string // 文件绝对路径
+	id        int
+	infoHash  string // 文件 hash id
+	filePath  string // 文件绝对路径
+	blockSize int    // 每块大小
 
 	stop      chan bool      // 退出标志
 	jobQueue  chan JobData   // 下载 job
 	dataQueue chan BlockData // 返回下载的数据块
 
-	stat                  uint      // 0: 运行中，1: 下载中，2: 已停止
-	lastDownloadBeginTime time.Time // 最后下载开始时间, 每完开始一次下载更新一次，用来控制下载阻塞，未完成状态的清理
-	totalDownload         int64     // 总共下载的数据量，单位字节
-	totalDownloadCost     int64     // 总共下载使用的时间
-	errorCount            int       // 下载出错的数量
-
-	peers []string // peer 地址列表，30 秒从 tracker 服务器获取一次
+	lock                  sync.Mutex         // 保护下载阻塞检查使用的字段
+	stat                  uint               // 0: 运行中，1: 下载中，2: 已停止
+	lastDownloadBeginTime time.Time          // 最后下载开始时间, 每完开始一次下载更新一次，用来控制下载阻塞，未完成状态的清理
+	totalDownload         int64              // 总共下载的数据量，单位字节
+	totalDownloadCost     int64              // 总共下载使用的时间，单位毫秒
+	errorCount            int                // 下载出错的数量
+	index                 int                // 正在下载的块
+	cancel                context.CancelFunc // 取消正在下载的块
+	stalled               bool               // 下载阻塞，请求被取消
+	limitWaits            int                // 正在等待限速的请求数量
+
+	peers    *Peers         // peer 地址列表，由 FileTasksMgr 定时从 tracker 服务器获取，所有 worker 共享
+	webSeed  *WebSeed       // web seed，没有 peer 可以提供数据时使用，所有 worker 共享
+	wire     *WirePool      // wire 连接池，为空时只使用 http，所有 worker 共享
+	limiters []*RateLimiter // 下载限速: 任务，节点
 }
 
 func (w *Worker) Run() {
@@ -263,12 +424,24 @@ func (w *Worker) Run() {
 		case jobData := <-w.jobQueue: // 等待获取下载数据片段的任务
 
 			// 下载数据
-			w.lastDownloadBeginTime = time.Now()
-			time.Sleep(time.Duration(rand.Int31n(1000)) * time.Millisecond)
-			blockData, _ := w.Download(&jobData)
+			beginTime := time.Now()
+			blockData, err := w.Download(&jobData)
+			w.lock.Lock()
+			if err != nil {
+				w.errorCount++
+			} else {
+				w.totalDownload += int64(len(blockData.data))
+				w.totalDownloadCost += int64(time.Since(beginTime) / time.Millisecond)
+			}
+			w.lock.Unlock()
 
 			// 写入存储数据的管道
-			w.dataQueue <- blockData
+			select {
+			case w.dataQueue <- blockData:
+			case _ = <-w.stop:
+				log.Info(fmt.Sprintf("Worker[%d] stop", w.id))
+				return
+			}
 
 		case _ = <-w.stop: // 停止工作
 			log.Info(fmt.Sprintf("Worker[%d] stop", w.id))
@@ -277,71 +450,307 @@ func (w *Worker) Run() {
 	}
 }
 
+func (w *Worker) Stop() {
+	close(w.stop)
+}
+
 /*
- * 从 tracker 服务器获取 peers 列表
+ * 开始下载一个块，记录取消下载的函数
  */
-func (w *Worker) GetPeersFromTracker() {
+func (w *Worker) beginJob(index int, cancel context.CancelFunc) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.index = index
+	w.cancel = cancel
+	w.stalled = false
+	w.lastDownloadBeginTime = time.Now()
 }
 
-func (w *Worker) Stop() {
-	w.stop <- true
+/*
+ * 块下载结束
+ */
+func (w *Worker) endJob() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.cancel = nil
+}
+
+/*
+ * 开始一个子块请求或者收到数据，更新最后下载开始时间
+ */
+func (w *Worker) touch() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.lastDownloadBeginTime = time.Now()
+}
+
+func (w *Worker) beginWait() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.limitWaits++
+}
+
+/*
+ * 限速等待结束，从结束时重新计算阻塞时间
+ */
+func (w *Worker) endWait() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.limitWaits--
+	w.lastDownloadBeginTime = time.Now()
+}
+
+func (w *Worker) isStalled() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.stalled
+}
+
+/*
+ * 检查 worker 是否阻塞，超时没有开始新的请求也没有收到数据时取消正在下载的块
+ * 返回是否取消了下载
+ */
+func (w *Worker) checkStall(now time.Time) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.cancel == nil || w.stalled || w.limitWaits > 0 ||
+		now.Sub(w.lastDownloadBeginTime) < WORKER_STALL_TIMEOUT*time.Second {
+		return false
+	}
+	w.stalled = true
+	w.cancel()
+	return true
 }
 
+/*
+ * 下载数据块
+ * 数据块分成多个子块，同时向多个 peer 请求，每个子块失败时换一个 peer 重试
+ */
 func (w *Worker) Download(jobData *JobData) (BlockData, error) {
 	log := logger.NewAgent()
 	defer log.EndLog()
 
-	log.Info(fmt.Sprintf("Worker[%d] is downloading data, infohash: %s, pos: %d, length: %d",
+	log.Info(fmt.Sprintf("Worker[%d] is downloading data, infohash: %s, block: %d, pos: %d, length: %d, single: %v",
 		w.id,
 		w.infoHash,
+		jobData.index,
 		jobData.pos,
-		jobData.length))
+		jobData.length,
+		jobData.single))
 
-	// 1. 下载数据块
-	peerId := setting.AppSetting.GetPeerId()
-	serv := setting.AppSetting.GetTrackerServ()
-	url := fmt.Sprintf("http://%s:%d/torrent?infohash=%s&peer_id=%s&port=%d",
-		serv.Ip,
-		serv.Port,
-		w.infoHash,
-		peerId,
-		setting.AppSetting.GetBtServ().Port)
-	log.Info(url)
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Err(fmt.Sprintf("Worker[%d] download %s fail, block: %d, err: %s",
-			w.id,
-			w.infoHash,
-			jobData.pos,
-			err.Error()))
-		return BlockData{isErr: 1}, errors.New("Worker download fail")
+	failData := BlockData{workId: w.id,
+		index:  jobData.index,
+		pos:    jobData.pos,
+		length: jobData.length,
+		isErr:  1}
+
+	// 1. 选择提供数据的 peer
+	pick := func(failed map[string]bool) (Peer, error) {
+		return jobData.flight.pickPeer(w.peers, jobData.index, failed)
 	}
-	if resp.StatusCode != http.StatusOK {
-		log.Err(fmt.Sprintf("Worker[%d] download %s fail, block: %d, http status: %s",
-			w.id,
-			w.infoHash,
-			jobData.pos,
-			resp.StatusCode))
-		return BlockData{isErr: 1}, errors.New("Worker download fail")
+	if jobData.single {
+		peer, err := jobData.flight.pickPeer(w.peers, jobData.index, nil)
+		if err != nil && w.webSeed == nil {
+			log.Err(fmt.Sprintf("Worker[%d] download %s fail, block: %d, err: %s",
+				w.id,
+				w.infoHash,
+				jobData.index,
+				err.Error()))
+			return failData, errors.New("Worker download fail")
+		}
+		if err != nil {
+			// 没有 peer 可以提供数据，整个块从 web seed 下载
+			pick = func(failed map[string]bool) (Peer, error) {
+				return Peer{}, err
+			}
+		} else {
+			w.peers.Release(peer.peerId)
+			pick = func(failed map[string]bool) (Peer, error) {
+				if failed[peer.peerId] {
+					return Peer{}, errors.New("single peer fail")
+				}
+				return w.peers.Acquire(peer.peerId)
+			}
+		}
 	}
-	defer resp.Body.Close()
 
-	result, err := ioutil.ReadAll(resp.Body)
+	// 2. 从 peer 下载数据块的子块
+	data := make([]byte, jobData.length)
+	peerIds, err := w.downloadPieces(jobData, data, pick)
 	if err != nil {
-		log.Err(fmt.Sprintf("Worker[%d] download %s read data block fail, block: %d, err: %s",
+		log.Err(fmt.Sprintf("Worker[%d] download %s fail, block: %d, err: %s",
 			w.id,
 			w.infoHash,
-			jobData.pos,
+			jobData.index,
 			err.Error()))
-		return BlockData{isErr: 1}, errors.New("Worker download fail")
+		failData.peerIds = peerIds
+		return failData, errors.New("Worker download fail")
 	}
 
 	// 组装数据
 	return BlockData{workId: w.id,
-		pos:    jobData.pos,
-		length: jobData.length,
-		data:   result,
-		isErr:  0}, nil
+		index:   jobData.index,
+		pos:     jobData.pos,
+		length:  jobData.length,
+		data:    data,
+		peerIds: peerIds,
+		isErr:   0}, nil
+}
+
+/*
+ * 按子块大小拆分下载请求，同时最多 SUB_BLOCK_PIPELINE 个请求
+ * 返回提供数据的 peer 列表
+ */
+func (w *Worker) downloadPieces(jobData *JobData,
+	data []byte,
+	pick func(failed map[string]bool) (Peer, error)) ([]string, error) {
+
+	ctx, cancel := context.WithCancel(jobData.flight.ctx)
+	defer cancel()
+	w.beginJob(jobData.index, cancel)
+	defer w.endJob()
+
+	blockOffset := jobData.pos - uint(jobData.index*w.blockSize)
+	pieces := make(chan uint, len(data)/SUB_BLOCK_SIZE+1)
+	for offset := uint(0); offset < jobData.length; offset += SUB_BLOCK_SIZE {
+		pieces <- offset
+	}
+	close(pieces)
+
+	var lock sync.Mutex
+	var firstErr error
+	usedPeers := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < SUB_BLOCK_PIPELINE; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range pieces {
+				length := uint(SUB_BLOCK_SIZE)
+				if offset+length > jobData.length {
+					length = jobData.length - offset
+				}
+				peerId, err := w.downloadPiece(ctx,
+					jobData.index,
+					blockOffset+offset,
+					data[offset:offset+length],
+					pick)
+
+				lock.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					cancel()
+				} else {
+					usedPeers[peerId] = true
+				}
+				lock.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	peerIds := []string{}
+	for peerId := range usedPeers {
+		peerIds = append(peerIds, peerId)
+	}
+	return peerIds, firstErr
+}
+
+/*
+ * 下载一个子块，失败时换一个 peer 重试
+ */
+func (w *Worker) downloadPiece(ctx context.Context,
+	index int,
+	offset uint,
+	buf []byte,
+	pick func(failed map[string]bool) (Peer, error)) (string, error) {
+
+	failed := make(map[string]bool)
+	var lastErr error
+	for retry := 0; retry < SUB_BLOCK_RETRY; retry++ {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		peer, err := pick(failed)
+		if err != nil && w.webSeed != nil && !failed[WEB_SEED_PEER_ID] {
+			// 没有 peer 可以提供数据时从 web seed 下载
+			failed[WEB_SEED_PEER_ID] = true
+			w.touch()
+			pos := int64(index*w.blockSize) + int64(offset)
+			if err := w.webSeed.Download(ctx, pos, buf, w, w.limiters...); err != nil {
+				lastErr = err
+				continue
+			}
+			return WEB_SEED_PEER_ID, nil
+		}
+		if err != nil {
+			if lastErr != nil {
+				return "", lastErr
+			}
+			return "", err
+		}
+
+		w.touch()
+		beginTime := time.Now()
+		data, err := w.fetch(ctx, peer, index, offset, uint(len(buf)))
+		if err == nil {
+			copy(buf, data)
+			w.peers.Record(peer.peerId, len(data), time.Since(beginTime), true)
+			w.peers.SetBlock(peer.peerId, index, PB_HAVE)
+			return peer.peerId, nil
+		}
+
+		lastErr = errors.New(fmt.Sprintf("download from %s fail, %s", peer.addr, err.Error()))
+		failed[peer.peerId] = true
+		if ctx.Err() != nil {
+			if w.isStalled() {
+				// 下载阻塞被取消，peer 长时间没有返回数据
+				w.peers.Record(peer.peerId, 0, time.Since(beginTime), false)
+				return "", errors.New(fmt.Sprintf("download from %s stalled", peer.addr))
+			}
+			// 请求被取消，不是 peer 的错误
+			w.peers.Release(peer.peerId)
+			return "", ctx.Err()
+		} else if err == ErrBlockNotFound {
+			w.peers.Release(peer.peerId)
+			w.peers.SetBlock(peer.peerId, index, PB_MISSING)
+		} else if busy, ok := err.(*PeerBusyError); ok {
+			// peer 没有空闲的上传位置，等待后重试
+			w.peers.Release(peer.peerId)
+			w.peers.Choke(peer.peerId, busy.retryAfter)
+		} else {
+			w.peers.Record(peer.peerId, 0, time.Since(beginTime), false)
+		}
+	}
+	return "", lastErr
+}
+
+/*
+ * 从 peer 下载子块，peer 提供 wire 服务时使用 wire 连接，连接失败时使用 http
+ */
+func (w *Worker) fetch(ctx context.Context, peer Peer, index int, offset uint, length uint) ([]byte, error) {
+	if w.wire != nil && peer.wireAddr != "" {
+		data, err := w.wire.Download(ctx, peer.peerId, peer.wireAddr, index, offset, length, w, w.limiters...)
+		if err != ErrWireUnavailable {
+			return data, err
+		}
+		// 不再使用 wire，下次同步 bitfield 时重新获取
+		w.peers.SetWireAddr(peer.peerId, "")
+	}
+	return downloadFromPeer(ctx, peer.addr, w.infoHash, index, offset, length, w, w.limiters...)
 }
 
 // ==========================================================================
@@ -357,6 +766,31 @@ type FileTasksMgr struct {
 
 	fileMeta     FileMeta
 	downloadWkrs []*Worker
+	peers        *Peers               // 下载任务的 peer 列表，所有 worker 共享
+	flights      map[int]*blockFlight // 下载中的块请求
+	ctx          context.Context      // 停止任务时取消所有请求
+	cancel       context.CancelFunc
+
+	downloadLimiter *RateLimiter // 任务下载限速
+	uploadLimiter   *RateLimiter // 任务上传限速
+	mem             *MemBudget   // 任务内存预算，下载中和上传中的数据块
+	choker          *Choker      // 上传位置
+	wire            *WirePool    // 下载使用的 wire 连接池
+
+	sequential bool        // 顺序下载模式，优先下载读取位置附近的块，用于边下载边播放
+	streams    map[int]int // 正在进行的边下载边播放请求的读取位置，块序号，有请求时按顺序下载
+	nextStream int         // 下一个边下载边播放请求的编号
+	blockDone  chan bool   // 块下载完成时关闭并重新创建，通知等待数据的读取方
+	haves      *HaveLog    // 最近完成的块，通知 peer
+	diskFull   bool        // 磁盘空间不足，暂停下载，剩余空间足够后恢复
+	queued     bool        // 排队等待开始下载
+	starting   bool        // 调度已经选择，正在开始下载
+
+	downloadPaused bool // 时间表暂停下载，时间段结束后恢复，由 FilesManager 设置所有任务，开始下载时保留
+
+	startErr   string    // 调度开始下载失败的原因
+	startFails int       // 调度连续开始失败的次数
+	retryAfter time.Time // 开始失败后，到期后重新调度
 
 	/*
 		0: 无状态（不分享）
@@ -369,7 +803,10 @@ type FileTasksMgr struct {
 	lastDownloadBeginTime time.Time // 下载开始时间
 	downloadCompleteTime  time.Time // 下载完成时间
 	totalDownload         int64     // 总共下载的数据量，单位字节
-	totalDownloadCost     int64     // 总共下载使用的时间
+	totalDownloadCost     int64     // 总共下载使用的时间，单位秒，不包括本次开始后的时间
+	totalUpload           int64     // 总共上传的数据量，单位字节
+	downloadMeter         RateMeter // 当前下载速度
+	uploadMeter           RateMeter // 当前上传速度
 }
 
 /*
@@ -425,13 +862,11 @@ func (ftMgr *FileTasksMgr) CreateShareFile(torrent []byte) (string,
 	}
 
 	ftMgr.fileMeta.contenttype = torrContent["contenttype"].(string)
-	if ftMgr.fileMeta.contenttype != "singlefile" {
-		return "", "", errors.New(fmt.Sprintf("torrent content type err, %s", ftMgr.fileMeta.contenttype))
-	}
 
 	ftMgr.fileMeta.maxDlThrNum = 0
 
-	ftMgr.fileMeta.stat = FM_STOP
+	// 分享的文件在本地是完整的
+	ftMgr.fileMeta.stat = FM_SHARE
 	ftMgr.fileMeta.fileDlPath = abSharePath
 	ftMgr.fileMeta.filename = torrContent["file_name"].(string)
 	ftMgr.fileMeta.fileMd5 = torrContent["file_md5"].(string)
@@ -439,10 +874,15 @@ func (ftMgr *FileTasksMgr) CreateShareFile(torrent []byte) (string,
 	ftMgr.fileMeta.blockCount = int(torrContent["part_count"].(float64))
 	ftMgr.fileMeta.fileSize = int(torrContent["file_size"].(float64))
 	ftMgr.fileMeta.blockSize = int(torrContent["block_size"].(float64))
+	if err := ftMgr.fileMeta.loadFiles(torrContent); err != nil {
+		log.Err(fmt.Sprintf("Load torrent files fail, md5: %s, %s", fileMd5, err.Error()))
+		return "", "", err
+	}
+	ftMgr.fileMeta.loadWebSeeds(torrContent)
 
 	blocks := []BlockMeta{}
 	for _, v := range torrContent["file_parts"].([]interface{}) {
-		blocks = append(blocks, BlockMeta{blockMd5: v.(string), blockStat: BS_UNDOWNLOAD})
+		blocks = append(blocks, BlockMeta{blockMd5: v.(string), blockStat: BS_COMPLETE})
 	}
 	ftMgr.fileMeta.blocks = blocks
 
@@ -490,11 +930,13 @@ func (ftMgr *FileTasksMgr) CreateShareFile(torrent []byte) (string,
  * 2. 保存种子文件: {root}/.uvdt/{fileMd5}/{fileMd5}.tor
  * 3. 创建下载状态文件: {root}/.uvdt/{fileMd5}/{fileMd5}.meta
  * 4. 下载目录不存在时创建目录，每个下载文件任务具有独立的目录
+ * 5. 多文件种子只下载选择的文件，sel 为 nil 时下载所有文件
  */
 func (ftMgr *FileTasksMgr) CreateDownloadFile(maxDlThrNum int,
 	fileMd5 string,
 	destDownloadPath string,
-	torrent []byte) error {
+	torrent []byte,
+	sel *FileSelection) error {
 
 	log := logger.NewAgent()
 	defer log.EndLog()
@@ -540,9 +982,6 @@ func (ftMgr *FileTasksMgr) CreateDownloadFile(maxDlThrNum int,
 	}
 
 	ftMgr.fileMeta.contenttype = torrContent["contenttype"].(string)
-	if ftMgr.fileMeta.contenttype != "singlefile" {
-		return errors.New(fmt.Sprintf("torrent content type err, %s", ftMgr.fileMeta.contenttype))
-	}
 
 	ftMgr.fileMeta.stat = FM_STOP
 	ftMgr.fileMeta.maxDlThrNum = maxDlThrNum
@@ -555,12 +994,52 @@ func (ftMgr *FileTasksMgr) CreateDownloadFile(maxDlThrNum int,
 	ftMgr.fileMeta.fileSize = int(torrContent["file_size"].(float64))
 	ftMgr.fileMeta.blockSize = int(torrContent["block_size"].(float64))
 
+	if err := ftMgr.fileMeta.loadFiles(torrContent); err != nil {
+		log.Err(fmt.Sprintf("Load torrent files fail, md5: %s, %s", fileMd5, err.Error()))
+		return err
+	}
+	ftMgr.fileMeta.loadWebSeeds(torrContent)
+
 	blocks := []BlockMeta{}
 	for _, v := range torrContent["file_parts"].([]interface{}) {
 		blocks = append(blocks, BlockMeta{blockMd5: v.(string), blockStat: BS_UNDOWNLOAD})
 	}
 	ftMgr.fileMeta.blocks = blocks
 
+	// 选择下载的文件
+	if err := ftMgr.fileMeta.applySelection(sel); err != nil {
+		log.Err(fmt.Sprintf("Select files fail, md5: %s, %s", fileMd5, err.Error()))
+		return err
+	}
+
+	// 检查剩余空间，预分配选择下载的文件
+	dataFiles := ftMgr.fileMeta.dataFiles()
+	needSize := int64(0)
+	for _, v := range dataFiles {
+		if v.priority == FP_SKIP {
+			continue
+		}
+		if fi, err := os.Stat(v.path); err != nil {
+			needSize += v.size
+		} else if fi.Size() < v.size {
+			needSize += v.size - fi.Size()
+		}
+	}
+	if err := checkFreeSpace(downloadPath, needSize); err != nil {
+		log.Err(fmt.Sprintf("Check free space fail, md5: %s, %s", fileMd5, err.Error()))
+		return err
+	}
+	for _, v := range dataFiles {
+		if v.priority == FP_SKIP {
+			continue
+		}
+		os.MkdirAll(filepath.Dir(v.path), os.ModeDir|os.ModePerm)
+		if err := preallocate(v.path, v.size); err != nil {
+			log.Err(fmt.Sprintf("Preallocate file fail, %s, %s", v.path, err.Error()))
+			return err
+		}
+	}
+
 	// 4. 创建元数据目录，创建元数据文件
 	if err := ftMgr.fileMeta.SaveMetaFile(fileMd5); err != nil {
 		log.Err(fmt.Sprintf("Save meta data fail, md5: %s", fileMd5))
@@ -598,71 +1077,1223 @@ func (ftMgr *FileTasksMgr) CreateDownloadFile(maxDlThrNum int,
 	return nil
 }
 
-func (ftMgr *FileTasksMgr) GetJob() JobData {
-	ftMgr.lock.Lock()
-	defer ftMgr.lock.Unlock()
-
-	// 获取下一个可下载块
-	return JobData{pos: 3, length: 1024}
+// 块的稀有程度，明确拥有和状态未知的 peer 数量
+type blockRarity struct {
+	have    int
+	unknown int
 }
 
-func (ftMgr *FileTasksMgr) Start(maxDlThrNum int,
-	filePath string,
-	md5 string) error {
+/*
+ * 比较稀有程度，更稀有时返回 -1
+ * 有 peer 明确拥有的块优先，拥有的 peer 越少越稀有，相同时按状态未知的 peer 数量比较
+ */
+func (r blockRarity) compare(other blockRarity) int {
+	switch {
+	case r.have > 0 && other.have == 0:
+		return -1
+	case r.have == 0 && other.have > 0:
+		return 1
+	case r.have != other.have:
+		if r.have < other.have {
+			return -1
+		}
+		return 1
+	case r.unknown != other.unknown:
+		if r.unknown < other.unknown {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
 
+/*
+ * 获取下一个可下载块，最少优先（rarest first）
+ * 1. 跳过已完成和下载中的块，跳过没有选择下载的文件的块
+ * 2. 1 分钟内失败次数达到上限的块，暂停下载到 1 分钟后
+ * 3. 优先选择优先级高的文件的块，其次选择最稀有的块（见 blockRarity），
+ *    相同时随机选择，避免所有节点下载相同的块
+ * 4. 顺序下载模式，优先选择读取位置之后的第一个可下载块，多个播放请求时使用最小的读取位置
+ * 5. 没有可下载的块，并且剩余的块少于 worker 数量时进入 endgame 阶段，
+ *    同一个块同时向多个 peer 请求，最先校验通过的数据写入文件，取消其他请求
+ */
+func (ftMgr *FileTasksMgr) GetJob() (JobData, error) {
 	ftMgr.lock.Lock()
 	defer ftMgr.lock.Unlock()
 
-	log := logger.NewAgent()
-	defer log.EndLog()
-
-	// 初始化元数据
-	ftMgr.maxDownloadThrNum = maxDlThrNum
-
-	metaPath := path.Join(setting.AppSetting.GetRootPath(), ".uvdt", md5)
-	jsonMetaFile := path.Join(metaPath, md5, ".meta")
-	if _, err := os.Stat(jsonMetaFile); os.IsNotExist(err) {
-	} else if os.IsExist(err) {
-		log.Err(fmt.Sprintf("The meta data is exist, %s", jsonMetaFile))
+	now := int(time.Now().Unix())
+	have, unknown := ftMgr.peers.Availability()
+	if len(ftMgr.fileMeta.webSeeds) > 0 {
+		// web seed 可以提供所有的块
+		for i := range have {
+			have[i]++
+		}
 	}
-	// 加载元数据
-	if err := ftMgr.fileMeta.LoadMetaFile(md5); err != nil {
-		log.Err(fmt.Sprintf("Load meta data fail, md5: %s", md5))
-		return err
+	avail := make([]int, len(have))
+	for i := range avail {
+		avail[i] = have[i] + unknown[i]
 	}
 
-	// 1. 当下载目录不存在时创建目录
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		log.Err(fmt.Sprintf("Create download filePath, %s", filePath))
-	}
+	index := -1
+	seqIndex := -1
+	cursor := ftMgr.readCursor()
+	maxPriority := 0
+	minRarity := blockRarity{}
+	ties := 0
+	remaining := 0
+	for i := range ftMgr.fileMeta.blocks {
+		block := &ftMgr.fileMeta.blocks[i]
+		if block.blockStat == BS_COMPLETE || block.priority == FP_SKIP {
+			continue
+		}
+		remaining++
+		if block.blockStat == BS_DOWNLOADING {
+			continue
+		}
+		if block.failCount >= BLOCK_MAX_FAIL_COUNT {
+			if now-block.lasttime < BLOCK_FAIL_BACKOFF {
+				continue
+			}
+			block.failCount = 0
+		}
+		if i >= len(avail) || avail[i] == 0 {
+			continue
+		}
+		if ftMgr.isSequential() && seqIndex < 0 && i >= cursor {
+			seqIndex = i
+		}
 
-	// 2. 创建下载 worker
-	jobQueue := make(chan JobData, ftMgr.maxDownloadThrNum)
-	ftMgr.dataQueue = make(chan BlockData, ftMgr.maxDownloadThrNum)
-	for i := 0; i < ftMgr.maxDownloadThrNum; i++ {
-		ftMgr.downloadWkrs = append(ftMgr.downloadWkrs,
-			&Worker{
-				id:        i,
-				infoHash:  ftMgr.fileMeta.fileMd5,
-				filePath:  filePath,
-				stop:      make(chan bool),
-				jobQueue:  jobQueue,
-				dataQueue: ftMgr.dataQueue})
+		rarity := blockRarity{have: have[i], unknown: unknown[i]}
+		if index < 0 || block.priority > maxPriority ||
+			(block.priority == maxPriority && rarity.compare(minRarity) < 0) {
+			index = i
+			maxPriority = block.priority
+			minRarity = rarity
+			ties = 1
+		} else if block.priority == maxPriority && rarity.compare(minRarity) == 0 {
+			ties++
+			if rand.Intn(ties) == 0 {
+				index = i
+			}
+		}
 	}
 
-	for _, v := range ftMgr.downloadWkrs {
-		// for i, v := range ftMgr.downloadWkrs {
-		// log.Info(fmt.Sprintf("download file=%s, goroutine=%d", filePath, i))
-		go v.Run()
+	if seqIndex >= 0 {
+		index = seqIndex
+	}
+	if index < 0 && remaining < len(ftMgr.downloadWkrs) {
+		index = ftMgr.endgameBlock(avail)
+	}
+	if index < 0 {
+		return JobData{}, errors.New("no block to download")
 	}
 
-	//
+	block := &ftMgr.fileMeta.blocks[index]
+	block.blockStat = BS_DOWNLOADING
+	block.lasttime = now
 
-	// 初始化统计数据
+	jobData := ftMgr.blockJob(index)
+	jobData.single = block.failCount > 0
+	jobData.flight = ftMgr.addFlight(index)
+	return jobData, nil
+}
 
-	// 创建保存数据的控制协程
-	ftMgr.stop = make(chan bool)
-	go func() {
+/*
+ * endgame 阶段选择请求数最少的下载中的块，每个块最多同时向 ENDGAME_MAX_REQUESTS 个 peer 请求
+ * 调用方加锁
+ */
+func (ftMgr *FileTasksMgr) endgameBlock(avail []int) int {
+	index := -1
+	minCount := 0
+	for i, flight := range ftMgr.flights {
+		if ftMgr.fileMeta.blocks[i].blockStat != BS_DOWNLOADING {
+			continue
+		}
+		if flight.count >= ENDGAME_MAX_REQUESTS || i >= len(avail) || flight.count >= avail[i] {
+			continue
+		}
+		if index < 0 || flight.count < minCount {
+			index = i
+			minCount = flight.count
+		}
+	}
+	return index
+}
+
+/*
+ * 添加块的下载请求，调用方加锁
+ */
+func (ftMgr *FileTasksMgr) addFlight(index int) *blockFlight {
+	flight, ok := ftMgr.flights[index]
+	if !ok {
+		ctx, cancel := context.WithCancel(ftMgr.ctx)
+		flight = &blockFlight{ctx: ctx,
+			cancel: cancel,
+			peers:  make(map[string]bool)}
+		ftMgr.flights[index] = flight
+	}
+	flight.count++
+	return flight
+}
+
+/*
+ * 块的请求返回
+ * 1. 下载成功时取消该块其他的请求
+ * 2. 下载失败并且没有其他未返回的请求时，记录失败
+ */
+func (ftMgr *FileTasksMgr) finishFlight(index int, succ bool) {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	flight, ok := ftMgr.flights[index]
+	if !ok {
+		return
+	}
+	flight.count--
+
+	if succ {
+		flight.cancel()
+		delete(ftMgr.flights, index)
+		return
+	}
+	if flight.count > 0 {
+		return
+	}
+	flight.cancel()
+	delete(ftMgr.flights, index)
+	if ftMgr.fileMeta.blocks[index].blockStat == BS_COMPLETE {
+		return
+	}
+	if ftMgr.diskFull || ftMgr.downloadPaused {
+		// 磁盘空间不足或者时间表暂停下载取消的请求不是块的错误，不记录失败次数
+		ftMgr.fileMeta.blocks[index].blockStat = BS_UNCOMPLETE
+		return
+	}
+	ftMgr.failBlock(index)
+}
+
+/*
+ * 计算块在文件内的位置和长度，最后一块可能小于块大小
+ */
+func (ftMgr *FileTasksMgr) blockJob(index int) JobData {
+	pos := index * ftMgr.fileMeta.blockSize
+	length := ftMgr.fileMeta.blockSize
+	if pos+length > ftMgr.fileMeta.fileSize {
+		length = ftMgr.fileMeta.fileSize - pos
+	}
+	return JobData{index: index, pos: uint(pos), length: uint(length)}
+}
+
+/*
+ * 块下载失败，记录失败次数，超过 1 分钟重新计数
+ * 调用方加锁
+ */
+func (ftMgr *FileTasksMgr) failBlock(index int) {
+	if index < 0 || index >= len(ftMgr.fileMeta.blocks) {
+		return
+	}
+	now := int(time.Now().Unix())
+	block := &ftMgr.fileMeta.blocks[index]
+	if now-block.lasttime >= BLOCK_FAIL_BACKOFF {
+		block.failCount = 0
+	}
+	block.blockStat = BS_UNCOMPLETE
+	block.failCount++
+	block.lasttime = now
+}
+
+/*
+ * 保存下载的数据块
+ * 1. 检查数据长度和块 md5，校验失败的块由调用方记录失败后重新下载
+ * 2. 按文件内位置写入文件
+ * 3. 标记块已完成，保存元数据文件
+ */
+func (ftMgr *FileTasksMgr) saveBlock(blockData *BlockData) error {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	ftMgr.lock.RLock()
+	if blockData.index < 0 || blockData.index >= len(ftMgr.fileMeta.blocks) {
+		ftMgr.lock.RUnlock()
+		return errors.New(fmt.Sprintf("block index err, %d", blockData.index))
+	}
+	jobData := ftMgr.blockJob(blockData.index)
+	blockMd5 := ftMgr.fileMeta.blocks[blockData.index].blockMd5
+	ftMgr.lock.RUnlock()
+
+	// 1. 校验数据
+	if uint(len(blockData.data)) != jobData.length || blockData.pos != jobData.pos {
+		errMsg := fmt.Sprintf("Block %d length err, expect: %d, got: %d",
+			blockData.index,
+			jobData.length,
+			len(blockData.data))
+		log.Err(errMsg)
+		ftMgr.blameBlock(blockData)
+		return errors.New(errMsg)
+	}
+	dataMd5 := fmt.Sprintf("%x", md5.Sum(blockData.data))
+	if dataMd5 != blockMd5 {
+		errMsg := fmt.Sprintf("Block %d md5 err, expect: %s, got: %s, peers: %v",
+			blockData.index,
+			blockMd5,
+			dataMd5,
+			blockData.peerIds)
+		log.Err(errMsg)
+		ftMgr.blameBlock(blockData)
+		return errors.New(errMsg)
+	}
+
+	// 2. 写入文件
+	if err := ftMgr.fileMeta.WriteAt(blockData.data, int64(jobData.pos)); err != nil {
+		log.Err(fmt.Sprintf("Write block %d fail, %s", blockData.index, err.Error()))
+		if isNoSpace(err) {
+			return ErrNoSpace
+		}
+		return err
+	}
+
+	// 3. 保存块状态
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	ftMgr.fileMeta.blocks[blockData.index].blockStat = BS_COMPLETE
+	ftMgr.fileMeta.blocks[blockData.index].failCount = 0
+	ftMgr.totalDownload += int64(len(blockData.data))
+	ftMgr.downloadMeter.Add(int64(len(blockData.data)))
+	close(ftMgr.blockDone)
+	ftMgr.blockDone = make(chan bool)
+	ftMgr.haves.Add(blockData.index)
+	if err := ftMgr.fileMeta.SaveMetaFile(ftMgr.fileMeta.fileMd5); err != nil {
+		log.Err(fmt.Sprintf("Save meta data fail, md5: %s, %s",
+			ftMgr.fileMeta.fileMd5,
+			err.Error()))
+		return err
+	}
+	log.Info(fmt.Sprintf("Save block %d of %s succ, worker: %d",
+		blockData.index,
+		ftMgr.fileMeta.fileMd5,
+		blockData.workId))
+
+	return nil
+}
+
+/*
+ * 重启后检查本地已下载的块，元数据和数据文件不一致时以数据文件为准
+ * 1. 数据文件不存在或长度不足的块，重新下载
+ * 2. 数据文件在元数据文件之后修改（写入数据后保存元数据前退出），
+ *    校验未完成但数据已写入的块，md5 一致时标记为已完成
+ * 调用方加锁
+ */
+func (ftMgr *FileTasksMgr) checkLocalBlocks() error {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	fileMeta := &ftMgr.fileMeta
+	suspect := false
+	sizes, dataModTime, err := fileMeta.localFiles()
+	if err != nil {
+		log.Err(fmt.Sprintf("Stat data file fail, %s", err.Error()))
+		return err
+	}
+	if !dataModTime.IsZero() {
+		metaInfo, err := os.Stat(fileMeta.fileMetaName)
+		if err != nil || dataModTime.After(metaInfo.ModTime()) {
+			suspect = true
+		}
+	}
+
+	reset := 0
+	recovered := 0
+	completed := 0
+	for i := range fileMeta.blocks {
+		block := &fileMeta.blocks[i]
+		jobData := ftMgr.blockJob(i)
+		exist := fileMeta.hasData(sizes, int64(jobData.pos), int(jobData.length))
+
+		if block.blockStat == BS_COMPLETE {
+			if !exist {
+				block.blockStat = BS_UNDOWNLOAD
+				reset++
+			} else {
+				completed++
+			}
+			continue
+		}
+
+		block.blockStat = BS_UNDOWNLOAD
+		if !suspect || !exist {
+			continue
+		}
+		data := make([]byte, jobData.length)
+		if err := fileMeta.ReadAt(data, int64(jobData.pos)); err != nil {
+			continue
+		}
+		if fmt.Sprintf("%x", md5.Sum(data)) == block.blockMd5 {
+			block.blockStat = BS_COMPLETE
+			recovered++
+			completed++
+		}
+	}
+
+	log.Info(fmt.Sprintf("Check local blocks %s, completed: %d/%d, reset: %d, recovered: %d",
+		fileMeta.fileMd5,
+		completed,
+		len(fileMeta.blocks),
+		reset,
+		recovered))
+
+	if reset > 0 || recovered > 0 {
+		return fileMeta.SaveMetaFile(fileMeta.fileMd5)
+	}
+	return nil
+}
+
+/*
+ * 块校验失败，只有一个 peer 提供数据时可以确定是该 peer 的错误
+ * 多个 peer 提供数据时，重新下载时只从一个 peer 下载
+ */
+func (ftMgr *FileTasksMgr) blameBlock(blockData *BlockData) {
+	if len(blockData.peerIds) == 1 {
+		ftMgr.peers.HashFail(blockData.peerIds[0])
+	}
+}
+
+/*
+ * 处理 worker 返回的数据块，endgame 阶段重复下载的数据块直接丢弃
+ */
+func (ftMgr *FileTasksMgr) handleBlockData(blockData *BlockData) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	succ := false
+	if blockData.isErr == 0 {
+		ftMgr.lock.RLock()
+		complete := blockData.index >= 0 &&
+			blockData.index < len(ftMgr.fileMeta.blocks) &&
+			ftMgr.fileMeta.blocks[blockData.index].blockStat == BS_COMPLETE
+		ftMgr.lock.RUnlock()
+
+		if complete {
+			log.Info(fmt.Sprintf("worker[%d] block %d is complete, drop data",
+				blockData.workId,
+				blockData.index))
+		} else {
+			log.Info(fmt.Sprintf("worker[%d] download data length: %d",
+				blockData.workId,
+				blockData.length))
+			err := ftMgr.saveBlock(blockData)
+			if err == ErrNoSpace {
+				ftMgr.pauseNoSpace()
+			}
+			succ = err == nil
+		}
+	}
+
+	ftMgr.finishFlight(blockData.index, succ)
+}
+
+/*
+ * 磁盘空间不足，暂停下载，取消下载中的请求，块重新放回队列
+ * 任务保持下载状态，已完成的块继续上传
+ */
+func (ftMgr *FileTasksMgr) pauseNoSpace() {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	if ftMgr.diskFull {
+		return
+	}
+	log.Err(fmt.Sprintf("Task %s pause, no space left on device", ftMgr.fileMeta.fileMd5))
+	ftMgr.diskFull = true
+	for _, flight := range ftMgr.flights {
+		flight.cancel()
+	}
+}
+
+/*
+ * 磁盘空间不足暂停后，检查剩余空间，足够所有 worker 写入时恢复下载
+ * 返回是否可以继续下载
+ */
+func (ftMgr *FileTasksMgr) checkDiskSpace() bool {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	if !ftMgr.diskFull {
+		return true
+	}
+	needSize := int64(ftMgr.fileMeta.blockSize) * int64(ftMgr.maxDownloadThrNum)
+	if err := checkFreeSpace(ftMgr.fileMeta.fileDlPath, needSize); err != nil {
+		return false
+	}
+	log.Info(fmt.Sprintf("Task %s resume, disk space is enough", ftMgr.fileMeta.fileMd5))
+	ftMgr.diskFull = false
+	return true
+}
+
+/*
+ * 填充下载任务队列，只有控制协程写入队列，队列满时不会阻塞
+ * 每个任务按块大小申请内存，内存达到任务上限时不再添加，数据块处理完成后释放
+ */
+func (ftMgr *FileTasksMgr) dispatchJobs(jobQueue chan JobData) {
+	blockSize := int64(ftMgr.fileMeta.blockSize)
+	for len(jobQueue) < cap(jobQueue) {
+		if !ftMgr.mem.TryAcquire(blockSize) {
+			return
+		}
+		jobData, err := ftMgr.GetJob()
+		if err != nil {
+			ftMgr.mem.Release(blockSize)
+			return
+		}
+		jobQueue <- jobData
+	}
+}
+
+/*
+ * 返回任务已使用的内存，内存上限，使用的峰值，单位：字节
+ */
+func (ftMgr *FileTasksMgr) GetMemUsage() (int64, int64, int64) {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	if ftMgr.mem == nil {
+		return 0, 0, 0
+	}
+	return ftMgr.mem.Usage()
+}
+
+/*
+ * 向 tracker 服务器报告本节点，并获取 peers 列表
+ * 返回下一次报告的间隔时间，单位秒
+ */
+func (ftMgr *FileTasksMgr) GetPeersFromTracker() (int, error) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	peerId := setting.AppSetting.GetPeerId()
+	serv := setting.AppSetting.GetTrackerServ()
+	url := fmt.Sprintf("http://%s:%d/node?infohash=%s&peer_id=%s&port=%d",
+		serv.Ip,
+		serv.Port,
+		ftMgr.fileMeta.fileMd5,
+		peerId,
+		setting.AppSetting.GetBtServ().Port)
+	log.Info(url)
+	resp, err := trackerClient.Get(url)
+	if err != nil {
+		log.Err(fmt.Sprintf("Announce to tracker fail, %s", err.Error()))
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errMsg := fmt.Sprintf("Announce to tracker fail. Http code is %d",
+			resp.StatusCode)
+		log.Err(errMsg)
+		return 0, errors.New(errMsg)
+	}
+
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Err(fmt.Sprintf("Read tracker response fail, %s", err.Error()))
+		return 0, err
+	}
+
+	// 解析 tracker 返回的结果
+	// {"status": 0, "result": {"infohash": "", "peers": ["peer_id:ip:port"], "interval": 30}}
+	servResult := make(map[string]interface{})
+	if err := json.Unmarshal(result, &servResult); err != nil {
+		log.Err(fmt.Sprintf("Parse json tracker response fail, %s", err.Error()))
+		return 0, err
+	}
+	if status, ok := servResult["status"].(float64); !ok || status != 0 {
+		errMsg := fmt.Sprintf("Announce to tracker status error, %v", servResult["msg"])
+		log.Err(errMsg)
+		return 0, errors.New(errMsg)
+	}
+
+	servResultVal, ok := servResult["result"].(map[string]interface{})
+	if !ok {
+		return 0, errors.New("Announce to tracker result error")
+	}
+	peerList := []string{}
+	if peers, ok := servResultVal["peers"].([]interface{}); ok {
+		for _, v := range peers {
+			if peer, ok := v.(string); ok {
+				peerList = append(peerList, peer)
+			}
+		}
+	}
+	interval := ANNOUNCE_INTERVAL
+	if v, ok := servResultVal["interval"].(float64); ok && v > 0 {
+		interval = int(v)
+	}
+
+	added, removed := ftMgr.peers.Merge(peerList)
+	log.Info(fmt.Sprintf("Update peers %s, added: %d, removed: %d, total: %d",
+		ftMgr.fileMeta.fileMd5,
+		added,
+		removed,
+		ftMgr.peers.Count()))
+
+	return interval, nil
+}
+
+/*
+ * 按 tracker 返回的间隔时间定时报告，失败时按默认间隔重试
+ */
+func (ftMgr *FileTasksMgr) announceLoop(stop chan bool) {
+	for {
+		interval, err := ftMgr.GetPeersFromTracker()
+		if err != nil {
+			interval = ANNOUNCE_INTERVAL
+		}
+
+		select {
+		case <-time.After(time.Duration(interval) * time.Second):
+		case _ = <-stop:
+			return
+		}
+	}
+}
+
+/*
+ * 分享任务，加载元数据，定时向 tracker 服务器报告本节点
+ */
+func (ftMgr *FileTasksMgr) StartShare(md5 string) error {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	if err := ftMgr.fileMeta.LoadMetaFile(md5); err != nil {
+		log.Err(fmt.Sprintf("Load meta data fail, md5: %s", md5))
+		return err
+	}
+
+	ftMgr.stat = FM_SHARE
+	ftMgr.peers = NewPeers(ftMgr.fileMeta.blockCount)
+	ftMgr.flights = make(map[int]*blockFlight)
+	ftMgr.ctx, ftMgr.cancel = context.WithCancel(context.Background())
+	ftMgr.blockDone = make(chan bool)
+	ftMgr.haves = NewHaveLog()
+	ftMgr.downloadLimiter = NewRateLimiter(int64(setting.AppSetting.GetTaskDownloadRate()) << 10)
+	ftMgr.uploadLimiter = NewRateLimiter(int64(setting.AppSetting.GetTaskUploadRate()) << 10)
+	ftMgr.mem = NewMemBudget(int64(setting.AppSetting.GetMaxMemPerFile()) << 20)
+	if ftMgr.choker != nil {
+		ftMgr.choker.Close()
+	}
+	ftMgr.choker = NewChoker(setting.AppSetting.GetUploadSlots())
+
+	ftMgr.stop = make(chan bool)
+	go ftMgr.announceLoop(ftMgr.stop)
+
+	log.Info(fmt.Sprintf("Task %s[%s] share", ftMgr.fileMeta.filename, md5))
+	return nil
+}
+
+func (ftMgr *FileTasksMgr) GetInfoHash() string {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.fileMeta.fileMd5
+}
+
+func (ftMgr *FileTasksMgr) GetFileName() string {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.fileMeta.filename
+}
+
+func (ftMgr *FileTasksMgr) GetFileSize() int {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.fileMeta.fileSize
+}
+
+/*
+ * 设置任务的下载，上传限速，单位：字节/秒，0: 不限速
+ */
+func (ftMgr *FileTasksMgr) SetRateLimit(downloadRate int64, uploadRate int64) {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	if ftMgr.downloadLimiter != nil {
+		ftMgr.downloadLimiter.SetRate(downloadRate)
+		ftMgr.uploadLimiter.SetRate(uploadRate)
+	}
+}
+
+/*
+ * 获取任务的下载，上传限速，单位：字节/秒
+ */
+func (ftMgr *FileTasksMgr) GetRateLimit() (int64, int64) {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	if ftMgr.downloadLimiter == nil {
+		return 0, 0
+	}
+	return ftMgr.downloadLimiter.GetRate(), ftMgr.uploadLimiter.GetRate()
+}
+
+/*
+ * 设置顺序下载模式
+ */
+func (ftMgr *FileTasksMgr) SetSequential(sequential bool) {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	ftMgr.sequential = sequential
+}
+
+/*
+ * 开始和结束边下载边播放的请求，请求期间按顺序下载，不改变设置的下载模式
+ * 每个请求有独立的读取位置，返回请求编号
+ */
+func (ftMgr *FileTasksMgr) BeginStream() int {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	if ftMgr.streams == nil {
+		ftMgr.streams = make(map[int]int)
+	}
+	ftMgr.nextStream++
+	ftMgr.streams[ftMgr.nextStream] = 0
+	return ftMgr.nextStream
+}
+
+func (ftMgr *FileTasksMgr) EndStream(stream int) {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	delete(ftMgr.streams, stream)
+}
+
+/*
+ * 是否按顺序下载，调用方加锁
+ */
+func (ftMgr *FileTasksMgr) isSequential() bool {
+	return ftMgr.sequential || len(ftMgr.streams) > 0
+}
+
+/*
+ * 顺序下载的读取位置，多个播放请求时使用最小的位置，没有播放请求时从头开始，调用方加锁
+ */
+func (ftMgr *FileTasksMgr) readCursor() int {
+	cursor := -1
+	for _, v := range ftMgr.streams {
+		if cursor < 0 || v < cursor {
+			cursor = v
+		}
+	}
+	if cursor < 0 {
+		return 0
+	}
+	return cursor
+}
+
+/*
+ * 设置播放请求的读取位置，pos 为文件内位置
+ */
+func (ftMgr *FileTasksMgr) SetReadCursor(stream int, pos int) {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	if _, ok := ftMgr.streams[stream]; ok && ftMgr.fileMeta.blockSize > 0 {
+		ftMgr.streams[stream] = pos / ftMgr.fileMeta.blockSize
+	}
+}
+
+/*
+ * 是否可以边下载边播放，任务正在下载或者分享，不在排队
+ */
+func (ftMgr *FileTasksMgr) IsStreamable() bool {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return !ftMgr.queued && (ftMgr.stat == FM_DOWNLOAD || ftMgr.stat == FM_SHARE)
+}
+
+/*
+ * 等待文件区间内的块下载完成，ctx 取消时返回错误
+ * stream 为播放请求编号，等待时把读取位置设置为缺少的块
+ */
+func (ftMgr *FileTasksMgr) WaitRange(ctx context.Context, stream int, pos int, length int) error {
+	for {
+		ftMgr.lock.Lock()
+		if ftMgr.blockDone == nil {
+			ftMgr.lock.Unlock()
+			return errors.New("task not started")
+		}
+		missing := -1
+		blockSize := ftMgr.fileMeta.blockSize
+		for i := pos / blockSize; i <= (pos+length-1)/blockSize && i < len(ftMgr.fileMeta.blocks); i++ {
+			if ftMgr.fileMeta.blocks[i].blockStat != BS_COMPLETE {
+				missing = i
+				break
+			}
+		}
+		if missing < 0 {
+			ftMgr.lock.Unlock()
+			return nil
+		}
+		// 没有选择下载的文件不会下载
+		if ftMgr.fileMeta.blocks[missing].priority == FP_SKIP {
+			ftMgr.lock.Unlock()
+			return errors.New(fmt.Sprintf("block %d is not selected", missing))
+		}
+		// 从缺少的块开始顺序下载
+		if _, ok := ftMgr.streams[stream]; ok {
+			ftMgr.streams[stream] = missing
+		}
+		blockDone := ftMgr.blockDone
+		ftMgr.lock.Unlock()
+
+		select {
+		case <-blockDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (ftMgr *FileTasksMgr) GetStat() uint {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.stat
+}
+
+/*
+ * 选择下载的文件需要的块是否都已下载完成
+ */
+func (ftMgr *FileTasksMgr) IsDownloadComplete() bool {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.selectedComplete()
+}
+
+/*
+ * 校验整个文件的 md5，不一致时重新校验每个块，校验失败的块重新下载
+ */
+func (ftMgr *FileTasksMgr) verifyFile() error {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	h := md5.New()
+	if err := ftMgr.fileMeta.copyData(h); err != nil {
+		log.Err(fmt.Sprintf("Read data file fail, %s", err.Error()))
+		return err
+	}
+	fileMd5 := fmt.Sprintf("%x", h.Sum(nil))
+	if fileMd5 == ftMgr.fileMeta.fileMd5 {
+		return nil
+	}
+	errMsg := fmt.Sprintf("File md5 err, expect: %s, got: %s",
+		ftMgr.fileMeta.fileMd5,
+		fileMd5)
+	log.Err(errMsg)
+
+	// 重新校验每个块
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	reset := 0
+	for i := range ftMgr.fileMeta.blocks {
+		block := &ftMgr.fileMeta.blocks[i]
+		jobData := ftMgr.blockJob(i)
+		data := make([]byte, jobData.length)
+		if err := ftMgr.fileMeta.ReadAt(data, int64(jobData.pos)); err != nil ||
+			fmt.Sprintf("%x", md5.Sum(data)) != block.blockMd5 {
+			block.blockStat = BS_UNDOWNLOAD
+			reset++
+		}
+	}
+	log.Info(fmt.Sprintf("Reset blocks: %d", reset))
+	if reset == 0 {
+		// 所有块都正确，种子文件的 md5 与分块不一致
+		ftMgr.fileMeta.stat = FM_STOP
+		ftMgr.stat = FM_STOP
+	}
+	ftMgr.fileMeta.SaveMetaFile(ftMgr.fileMeta.fileMd5)
+
+	return errors.New(errMsg)
+}
+
+/*
+ * 下载完成，转为分享
+ * 1. 校验整个文件的 md5，只下载了部分文件时每个块已经校验过，不校验整个文件
+ * 2. 停止所有 worker，取消未完成的请求
+ * 3. 更新状态为分享中，保存元数据和 uvdt.dat
+ *    只下载了部分文件时 uvdt.dat 保持下载状态，重新启动后仍然可以选择其他文件继续下载
+ * 4. 向 tracker 服务器报告本节点，为其他 peer 提供下载
+ */
+func (ftMgr *FileTasksMgr) completeDownload() error {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	// 1. 校验整个文件
+	ftMgr.lock.RLock()
+	partial := !ftMgr.allComplete()
+	ftMgr.lock.RUnlock()
+	if !partial {
+		if err := ftMgr.verifyFile(); err != nil {
+			return err
+		}
+	}
+
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	// 2. 停止下载
+	for _, v := range ftMgr.downloadWkrs {
+		v.Stop()
+	}
+	ftMgr.downloadWkrs = nil
+	if ftMgr.wire != nil {
+		ftMgr.wire.Close()
+		ftMgr.wire = nil
+	}
+	for index, flight := range ftMgr.flights {
+		flight.cancel()
+		delete(ftMgr.flights, index)
+	}
+
+	// 3. 更新状态
+	ftMgr.totalDownloadCost = ftMgr.downloadTime()
+	ftMgr.stat = FM_SHARE
+	ftMgr.fileMeta.stat = FM_SHARE
+	ftMgr.downloadCompleteTime = time.Now()
+	if err := ftMgr.fileMeta.SaveMetaFile(ftMgr.fileMeta.fileMd5); err != nil {
+		log.Err(fmt.Sprintf("Save meta data fail, md5: %s", ftMgr.fileMeta.fileMd5))
+		return err
+	}
+	if partial {
+		log.Info(fmt.Sprintf("Task %s[%s] selected files download complete, state: share",
+			ftMgr.fileMeta.filename,
+			ftMgr.fileMeta.fileMd5))
+	} else {
+		if err := updateUvdtData(ftMgr.fileMeta.fileMd5, "share"); err != nil {
+			log.Err(fmt.Sprintf("Update uvdt data fail, %s", err.Error()))
+			return err
+		}
+		log.Info(fmt.Sprintf("Task %s[%s] download complete, state: share",
+			ftMgr.fileMeta.filename,
+			ftMgr.fileMeta.fileMd5))
+	}
+
+	// 4. 作为种子报告到 tracker 服务器
+	go ftMgr.GetPeersFromTracker()
+
+	return nil
+}
+
+/*
+ * 定时检查下载阻塞的 worker，取消阻塞的请求
+ * 取消后 worker 返回下载失败，块重新放回队列
+ */
+func (ftMgr *FileTasksMgr) watchdogLoop(stop chan bool) {
+	for {
+		select {
+		case <-time.After(WATCHDOG_INTERVAL * time.Second):
+		case _ = <-stop:
+			return
+		}
+
+		ftMgr.lock.RLock()
+		wkrs := ftMgr.downloadWkrs
+		ftMgr.lock.RUnlock()
+
+		now := time.Now()
+		for _, w := range wkrs {
+			if w.checkStall(now) {
+				log := logger.NewAgent()
+				log.Err(fmt.Sprintf("Worker[%d] of %s stalled, cancel download",
+					w.id,
+					ftMgr.fileMeta.fileMd5))
+				log.EndLog()
+			}
+		}
+	}
+}
+
+/*
+ * 下载任务排队等待，加载元数据，由 FilesManager 按优先级调度开始下载
+ */
+func (ftMgr *FileTasksMgr) Queue(md5 string) error {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	if err := ftMgr.fileMeta.LoadMetaFile(md5); err != nil {
+		log.Err(fmt.Sprintf("Load meta data fail, md5: %s", md5))
+		return err
+	}
+	ftMgr.queued = true
+	ftMgr.stat = FM_PAUSE
+	log.Info(fmt.Sprintf("Task %s[%s] queued, priority: %d",
+		ftMgr.fileMeta.filename,
+		md5,
+		ftMgr.fileMeta.priority))
+	return nil
+}
+
+/*
+ * 时间表暂停下载，取消下载中的请求，不再添加下载任务
+ * 任务保持下载状态，已完成的块继续上传，上传由 FilesManager.IsUploadPaused 控制
+ */
+func (ftMgr *FileTasksMgr) PauseDownload() {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	if ftMgr.downloadPaused {
+		return
+	}
+	ftMgr.downloadPaused = true
+	for _, flight := range ftMgr.flights {
+		flight.cancel()
+	}
+	log.Info(fmt.Sprintf("Task %s[%s] download paused",
+		ftMgr.fileMeta.filename,
+		ftMgr.fileMeta.fileMd5))
+}
+
+/*
+ * 时间表恢复下载
+ */
+func (ftMgr *FileTasksMgr) ResumeDownload() {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	if !ftMgr.downloadPaused {
+		return
+	}
+	ftMgr.downloadPaused = false
+	log.Info(fmt.Sprintf("Task %s[%s] download resumed",
+		ftMgr.fileMeta.filename,
+		ftMgr.fileMeta.fileMd5))
+}
+
+func (ftMgr *FileTasksMgr) IsDownloadPaused() bool {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.downloadPaused
+}
+
+/*
+ * 是否在排队等待开始下载
+ */
+func (ftMgr *FileTasksMgr) IsQueued() bool {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.queued
+}
+
+/*
+ * 调度选择任务开始下载或者开始结束
+ */
+func (ftMgr *FileTasksMgr) setStarting(starting bool) {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	ftMgr.starting = starting
+}
+
+func (ftMgr *FileTasksMgr) IsStarting() bool {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.starting
+}
+
+/*
+ * 是否正在下载，磁盘空间不足暂停的任务也占用下载数量
+ */
+func (ftMgr *FileTasksMgr) IsDownloading() bool {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.stat == FM_DOWNLOAD || ftMgr.diskFull
+}
+
+/*
+ * 设置排队下载的优先级，保存到元数据
+ */
+func (ftMgr *FileTasksMgr) SetPriority(priority int) error {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	ftMgr.fileMeta.priority = priority
+	return ftMgr.fileMeta.SaveMetaFile(ftMgr.fileMeta.fileMd5)
+}
+
+func (ftMgr *FileTasksMgr) GetPriority() int {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.fileMeta.priority
+}
+
+/*
+ * 停止下载任务，退出所有 worker 和控制协程
+ */
+func (ftMgr *FileTasksMgr) Stop() {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	if ftMgr.stop == nil {
+		return
+	}
+	close(ftMgr.stop)
+	ftMgr.stop = nil
+	ftMgr.cancel()
+	ftMgr.choker.Close()
+
+	for _, v := range ftMgr.downloadWkrs {
+		v.Stop()
+	}
+	ftMgr.downloadWkrs = nil
+	if ftMgr.wire != nil {
+		ftMgr.wire.Close()
+		ftMgr.wire = nil
+	}
+
+	// 停止的任务不再占用同时下载的数量
+	if ftMgr.stat == FM_DOWNLOAD || ftMgr.diskFull {
+		ftMgr.totalDownloadCost = ftMgr.downloadTime()
+		ftMgr.stat = FM_STOP
+		ftMgr.diskFull = false
+	}
+}
+
+func (ftMgr *FileTasksMgr) Start(maxDlThrNum int,
+	filePath string,
+	md5 string) error {
+
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	// 开始失败时为停止状态，不再排队
+	ftMgr.queued = false
+	ftMgr.stat = FM_STOP
+
+	// 初始化元数据
+	ftMgr.maxDownloadThrNum = maxDlThrNum
+
+	metaPath := path.Join(setting.AppSetting.GetRootPath(), ".uvdt", md5)
+	jsonMetaFile := path.Join(metaPath, md5, ".meta")
+	if _, err := os.Stat(jsonMetaFile); os.IsNotExist(err) {
+	} else if os.IsExist(err) {
+		log.Err(fmt.Sprintf("The meta data is exist, %s", jsonMetaFile))
+	}
+	// 加载元数据
+	if err := ftMgr.fileMeta.LoadMetaFile(md5); err != nil {
+		log.Err(fmt.Sprintf("Load meta data fail, md5: %s", md5))
+		return err
+	}
+
+	// 检查已下载的块，只下载未完成的块
+	if err := ftMgr.checkLocalBlocks(); err != nil {
+		log.Err(fmt.Sprintf("Check local blocks fail, md5: %s", md5))
+		return err
+	}
+
+	// 1. 当下载目录不存在时创建目录
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		log.Err(fmt.Sprintf("Create download filePath, %s", filePath))
+	}
+	ftMgr.stat = FM_DOWNLOAD
+	ftMgr.fileMeta.stat = FM_DOWNLOAD
+	ftMgr.lastDownloadBeginTime = time.Now()
+	ftMgr.startErr = ""
+	ftMgr.startFails = 0
+
+	// 2. 创建下载 worker，所有 worker 共享 peers 列表
+	ftMgr.peers = NewPeers(ftMgr.fileMeta.blockCount)
+	ftMgr.flights = make(map[int]*blockFlight)
+	ftMgr.ctx, ftMgr.cancel = context.WithCancel(context.Background())
+	ftMgr.blockDone = make(chan bool)
+	ftMgr.haves = NewHaveLog()
+	ftMgr.downloadLimiter = NewRateLimiter(int64(setting.AppSetting.GetTaskDownloadRate()) << 10)
+	ftMgr.uploadLimiter = NewRateLimiter(int64(setting.AppSetting.GetTaskUploadRate()) << 10)
+	ftMgr.mem = NewMemBudget(int64(setting.AppSetting.GetMaxMemPerFile()) << 20)
+	if ftMgr.choker != nil {
+		ftMgr.choker.Close()
+	}
+	ftMgr.choker = NewChoker(setting.AppSetting.GetUploadSlots())
+	if ftMgr.wire != nil {
+		ftMgr.wire.Close()
+		ftMgr.wire = nil
+	}
+	if setting.AppSetting.GetTransport() == TRANSPORT_WIRE {
+		ftMgr.wire = NewWirePool(ftMgr.fileMeta.fileMd5, ftMgr.fileMeta.blockCount, ftMgr.peers)
+	}
+	jobQueue := make(chan JobData, ftMgr.maxDownloadThrNum)
+	ftMgr.dataQueue = make(chan BlockData, ftMgr.maxDownloadThrNum)
+	webSeed := NewWebSeed(&ftMgr.fileMeta)
+	for i := 0; i < ftMgr.maxDownloadThrNum; i++ {
+		ftMgr.downloadWkrs = append(ftMgr.downloadWkrs,
+			&Worker{
+				id:        i,
+				infoHash:  ftMgr.fileMeta.fileMd5,
+				filePath:  filePath,
+				blockSize: ftMgr.fileMeta.blockSize,
+				stop:      make(chan bool),
+				jobQueue:  jobQueue,
+				dataQueue: ftMgr.dataQueue,
+				peers:     ftMgr.peers,
+				webSeed:   webSeed,
+				wire:      ftMgr.wire,
+				limiters:  []*RateLimiter{ftMgr.downloadLimiter, downloadLimiter}})
+	}
+
+	for _, v := range ftMgr.downloadWkrs {
+		// for i, v := range ftMgr.downloadWkrs {
+		// log.Info(fmt.Sprintf("download file=%s, goroutine=%d", filePath, i))
+		go v.Run()
+	}
+
+	// 3. 定时从 tracker 服务器获取 peers 列表
+	ftMgr.stop = make(chan bool)
+	go ftMgr.announceLoop(ftMgr.stop)
+
+	// 4. 定时检查下载阻塞的 worker
+	go ftMgr.watchdogLoop(ftMgr.stop)
+
+	// 5. 同步 peer 拥有的块
+	go ftMgr.peerSyncLoop(ftMgr.stop)
+
+	// 6. 与其他 peer 交换 peer 列表
+	go ftMgr.pexLoop(ftMgr.stop)
+
+	// 初始化统计数据
+
+	// 创建保存数据的控制协程
+	stop := ftMgr.stop
+	go func() {
 		log.Info("start save data goroutine ...")
 
 		for {
@@ -671,21 +2302,35 @@ func (ftMgr *FileTasksMgr) Start(maxDlThrNum int,
 
 			select {
 			case <-time.After(time.Second): // 超时, 判断是否需要添加下载数据任务队列中
-				jobQueue <- JobData{pos: 3, length: 1024}
 
 			case blockData := <-ftMgr.dataQueue: // 等待获取下载数据片段的任务
-				// 1. 下载数据
-				time.Sleep(time.Duration(rand.Int31n(100)) * time.Millisecond)
-				logData.Info(fmt.Sprintf("worker[%d] download data length: %d",
-					blockData.workId,
-					blockData.length))
-				jobQueue <- JobData{pos: 3, length: 1024}
-
-				// 2. 写入文件
-			case _ = <-ftMgr.stop: // 停止工作
+				// 校验并写入文件，释放数据块的内存
+				ftMgr.handleBlockData(&blockData)
+				ftMgr.mem.Release(int64(ftMgr.fileMeta.blockSize))
+
+			case _ = <-stop: // 停止工作
 				logData.Info(fmt.Sprintf("Task stop"))
 				return
 			}
+
+			// 所有块下载完成，转为分享
+			if ftMgr.IsDownloadComplete() {
+				if err := ftMgr.completeDownload(); err == nil {
+					logData.Info(fmt.Sprintf("Task complete"))
+					logData.EndLog()
+					return
+				} else if ftMgr.GetStat() == FM_STOP {
+					// 种子文件错误，无法完成下载
+					logData.Err(fmt.Sprintf("Task stop, %s", err.Error()))
+					logData.EndLog()
+					ftMgr.Stop()
+					return
+				}
+			}
+			// 磁盘空间不足或者时间表暂停下载时不添加下载任务
+			if !ftMgr.IsDownloadPaused() && ftMgr.checkDiskSpace() {
+				ftMgr.dispatchJobs(jobQueue)
+			}
 			logData.EndLog()
 		}
 	}()
@@ -0,0 +1,105 @@
+package nodeserv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBlockRarityCompare(t *testing.T) {
+	cases := []struct {
+		a, b blockRarity
+		want int
+	}{
+		{blockRarity{have: 1, unknown: 9}, blockRarity{have: 0, unknown: 1}, -1}, // 明确拥有的块优先
+		{blockRarity{have: 0, unknown: 1}, blockRarity{have: 1, unknown: 0}, 1},
+		{blockRarity{have: 1, unknown: 5}, blockRarity{have: 2, unknown: 0}, -1}, // 拥有的 peer 少的更稀有
+		{blockRarity{have: 2, unknown: 1}, blockRarity{have: 2, unknown: 3}, -1}, // 相同时比较未知状态
+		{blockRarity{have: 0, unknown: 2}, blockRarity{have: 0, unknown: 3}, -1}, // 交换 bitfield 之前
+		{blockRarity{have: 0, unknown: 3}, blockRarity{have: 0, unknown: 2}, 1},
+		{blockRarity{have: 3, unknown: 1}, blockRarity{have: 3, unknown: 1}, 0},
+	}
+	for _, c := range cases {
+		if got := c.a.compare(c.b); got != c.want {
+			t.Errorf("%+v compare %+v = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestWorkerLimitedDownloadNotStalled(t *testing.T) {
+	content := make([]byte, 3*RATE_LIMIT_CHUNK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	// 限速下载大约需要 2 秒，阻塞检查只允许 1 秒没有进度
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &Worker{}
+	w.beginJob(0, cancel)
+	w.lock.Lock()
+	w.lastDownloadBeginTime = time.Now().Add(time.Second - WORKER_STALL_TIMEOUT*time.Second)
+	w.lock.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				w.checkStall(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	limiter := NewRateLimiter(RATE_LIMIT_CHUNK)
+	data, err := downloadRange(ctx, server.URL, 0, uint(len(content)), w, limiter)
+	close(done)
+	if err != nil || len(data) != len(content) {
+		t.Fatalf("limited download fail, len: %d, err: %v", len(data), err)
+	}
+	if w.isStalled() {
+		t.Fatalf("limited download marked as stalled")
+	}
+
+	// 没有进度时仍然会被取消
+	w.lock.Lock()
+	w.lastDownloadBeginTime = time.Now().Add(-WORKER_STALL_TIMEOUT * time.Second)
+	w.lock.Unlock()
+	if !w.checkStall(time.Now()) || ctx.Err() == nil {
+		t.Fatalf("idle download not cancelled")
+	}
+}
+
+func TestStreamReadCursor(t *testing.T) {
+	ftMgr := &FileTasksMgr{}
+	ftMgr.fileMeta.blockSize = 10
+
+	first := ftMgr.BeginStream()
+	second := ftMgr.BeginStream()
+	ftMgr.SetReadCursor(first, 55)
+	ftMgr.SetReadCursor(second, 25)
+	if !ftMgr.isSequential() || ftMgr.readCursor() != 2 {
+		t.Fatalf("two streams, sequential: %v, cursor: %d, want true, 2", ftMgr.isSequential(), ftMgr.readCursor())
+	}
+
+	// 一个请求结束后使用另一个请求的读取位置
+	ftMgr.EndStream(second)
+	ftMgr.SetReadCursor(second, 0)
+	if ftMgr.readCursor() != 5 {
+		t.Fatalf("one stream, cursor: %d, want 5", ftMgr.readCursor())
+	}
+
+	ftMgr.EndStream(first)
+	if ftMgr.isSequential() || ftMgr.readCursor() != 0 {
+		t.Fatalf("no stream, sequential: %v, cursor: %d, want false, 0", ftMgr.isSequential(), ftMgr.readCursor())
+	}
+}
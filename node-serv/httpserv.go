@@ -5,7 +5,11 @@ package nodeserv
 
 import (
 	"fmt"
+	"mime"
 	"net/http"
+	"path"
+	"strconv"
+	"time"
 
 	"github.com/blueskyz/uvdt/logger"
 	"github.com/blueskyz/uvdt/node-serv/setting"
@@ -37,6 +41,22 @@ func HttpServ(filesManager *FilesManager) error {
 	// 添加下载任务
 	HttpServMux.HandleFunc("/api/download", httpHandler)
 
+	// 设置顺序下载模式
+	HttpServMux.HandleFunc("/api/task/sequential", apiSequentialHandler)
+
+	// 读取下载中的文件，支持 http range
+	HttpServMux.HandleFunc("/api/stream", apiStreamHandler)
+
+	// 设置节点或任务的限速
+	HttpServMux.HandleFunc("/api/ratelimit", apiRateLimitHandler)
+
+	// 设置排队下载任务的优先级，移动到排队的最前面
+	HttpServMux.HandleFunc("/api/task/priority", apiPriorityHandler)
+	HttpServMux.HandleFunc("/api/task/front", apiMoveToFrontHandler)
+
+	// 查看和设置多文件种子选择下载的文件
+	HttpServMux.HandleFunc("/api/task/files", apiTaskFilesHandler)
+
 	httpServ := setting.AppSetting.GetHttpServ()
 	log.Info(fmt.Sprintf("%s:%d", httpServ.Ip, httpServ.Port))
 	err := http.ListenAndServe(fmt.Sprintf("%s:%d",
@@ -79,3 +99,206 @@ func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(showFilesList))
 	*/
 }
+
+/*
+ * 设置任务的顺序下载模式
+ */
+func apiSequentialHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	values := r.URL.Query()
+	infoHash := values.Get("infohash")
+	ftMgr := filesMgr.GetTask(infoHash)
+	if ftMgr == nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Task not exist, %s", infoHash))
+		return
+	}
+
+	enable := values.Get("enable") == "1"
+	ftMgr.SetSequential(enable)
+	utils.CreateSuccResp(w,
+		&log,
+		fmt.Sprintf("Set sequential %s: %v", infoHash, enable),
+		map[string]interface{}{"sequential": enable})
+}
+
+/*
+ * 读取下载中的文件，请求的块未下载完成时等待下载
+ */
+func apiStreamHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	infoHash := r.URL.Query().Get("infohash")
+	ftMgr := filesMgr.GetTask(infoHash)
+	if ftMgr == nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Task not exist, %s", infoHash))
+		return
+	}
+	// 任务没有开始或者在排队时不能读取
+	if !ftMgr.IsStreamable() {
+		log.Err(fmt.Sprintf("Stream %s fail, task is not started", infoHash))
+		http.Error(w, "task is not started", http.StatusServiceUnavailable)
+		return
+	}
+	log.Info(fmt.Sprintf("Stream %s, range: %s", infoHash, r.Header.Get("Range")))
+
+	// 播放期间顺序下载，请求结束后恢复
+	stream := ftMgr.BeginStream()
+	defer ftMgr.EndStream(stream)
+
+	filename := ftMgr.GetFileName()
+	contentType := mime.TypeByExtension(path.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, filename, time.Time{}, newStreamReader(r.Context(), ftMgr, stream))
+}
+
+/*
+ * 设置限速，单位：KB/s，0: 不限速，没有 infohash 参数时设置节点限速
+ * /api/ratelimit?infohash=xxx&download=1024&upload=512
+ */
+func apiRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	values := r.URL.Query()
+	infoHash := values.Get("infohash")
+
+	// 1. 获取当前限速
+	var ftMgr *FileTasksMgr
+	var downloadRate, uploadRate int64
+	if infoHash == "" {
+		downloadRate = downloadLimiter.GetRate()
+		uploadRate = uploadLimiter.GetRate()
+	} else {
+		ftMgr = filesMgr.GetTask(infoHash)
+		if ftMgr == nil {
+			utils.CreateErrResp(w, &log, fmt.Sprintf("Task not exist, %s", infoHash))
+			return
+		}
+		downloadRate, uploadRate = ftMgr.GetRateLimit()
+	}
+
+	// 2. 解析参数，没有的参数保持不变
+	if v := values.Get("download"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate < 0 {
+			utils.CreateErrResp(w, &log, fmt.Sprintf("download rate err, %s", v))
+			return
+		}
+		downloadRate = int64(rate) << 10
+	}
+	if v := values.Get("upload"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate < 0 {
+			utils.CreateErrResp(w, &log, fmt.Sprintf("upload rate err, %s", v))
+			return
+		}
+		uploadRate = int64(rate) << 10
+	}
+
+	// 3. 设置限速
+	if ftMgr == nil {
+		downloadLimiter.SetRate(downloadRate)
+		uploadLimiter.SetRate(uploadRate)
+		setting.AppSetting.SetDownloadRate(int(downloadRate >> 10))
+		setting.AppSetting.SetUploadRate(int(uploadRate >> 10))
+	} else {
+		ftMgr.SetRateLimit(downloadRate, uploadRate)
+	}
+
+	utils.CreateSuccResp(w,
+		&log,
+		fmt.Sprintf("Set rate limit %s, download: %d, upload: %d",
+			infoHash,
+			downloadRate,
+			uploadRate),
+		map[string]interface{}{
+			"infohash": infoHash,
+			"download": downloadRate >> 10,
+			"upload":   uploadRate >> 10,
+		})
+}
+
+/*
+ * 设置任务的优先级，数值大的先开始下载
+ * /api/task/priority?infohash=xxx&priority=10
+ */
+func apiPriorityHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	values := r.URL.Query()
+	infoHash := values.Get("infohash")
+	priority, err := strconv.Atoi(values.Get("priority"))
+	if err != nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("priority err, %s", values.Get("priority")))
+		return
+	}
+
+	if err := filesMgr.SetTaskPriority(infoHash, priority); err != nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Set priority fail, %s", err.Error()))
+		return
+	}
+	utils.CreateSuccResp(w,
+		&log,
+		fmt.Sprintf("Set priority %s: %d", infoHash, priority),
+		map[string]interface{}{"infohash": infoHash, "priority": priority})
+}
+
+/*
+ * 把排队的任务移动到最前面
+ * /api/task/front?infohash=xxx
+ */
+func apiMoveToFrontHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	infoHash := r.URL.Query().Get("infohash")
+	priority, err := filesMgr.MoveTaskToFront(infoHash)
+	if err != nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Move task to front fail, %s", err.Error()))
+		return
+	}
+	utils.CreateSuccResp(w,
+		&log,
+		fmt.Sprintf("Move task to front %s, priority: %d", infoHash, priority),
+		map[string]interface{}{"infohash": infoHash, "priority": priority})
+}
+
+/*
+ * 查看任务的文件列表，有选择参数时重新设置选择下载的文件
+ * /api/task/files?infohash=xxx&include=docs/&exclude=*.tmp&priority=a.mp4:high
+ */
+func apiTaskFilesHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	values := r.URL.Query()
+	infoHash := values.Get("infohash")
+	ftMgr := filesMgr.GetTask(infoHash)
+	if ftMgr == nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("Task not exist, %s", infoHash))
+		return
+	}
+
+	sel, err := parseFileSelection(values)
+	if err != nil {
+		utils.CreateErrResp(w, &log, fmt.Sprintf("File selection err, %s", err.Error()))
+		return
+	}
+	if sel != nil {
+		if err := filesMgr.SetTaskFiles(infoHash, sel); err != nil {
+			utils.CreateErrResp(w, &log, fmt.Sprintf("Set task files fail, %s", err.Error()))
+			return
+		}
+	}
+	utils.CreateSuccResp(w,
+		&log,
+		fmt.Sprintf("Task files %s", infoHash),
+		map[string]interface{}{"infohash": infoHash, "files": ftMgr.GetFiles()})
+}
@@ -27,14 +27,38 @@ type FilesManager struct {
 	maxFileNum uint
 	lock       sync.RWMutex
 
-	fileTasksMgr []FileTasksMgr
+	fileTasksMgr []*FileTasksMgr
+
+	// 按时间段控制传输
+	timeRules      []TimeRule
+	timeRuleIndex  int  // 当前使用的时间段，TIME_RULE_NONE: 没有匹配的时间段，TIME_RULE_UNSET: 还没有应用
+	downloadPaused bool // 暂停下载
+	uploadPaused   bool // 暂停上传
 }
 
 func CreateFilesMgr() (*FilesManager, error) {
 
 	filesMgr := &FilesManager{
-		maxFileNum: setting.AppSetting.GetMaxFileNum(),
-		lock:       sync.RWMutex{},
+		maxFileNum:    setting.AppSetting.GetMaxFileNum(),
+		lock:          sync.RWMutex{},
+		timeRuleIndex: TIME_RULE_UNSET,
+	}
+
+	// 节点限速
+	downloadLimiter.SetRate(int64(setting.AppSetting.GetDownloadRate()) << 10)
+	uploadLimiter.SetRate(int64(setting.AppSetting.GetUploadRate()) << 10)
+
+	// 节点的上传位置
+	nodeUploadSlots.SetLimit(setting.AppSetting.GetNodeUploadSlots())
+
+	// 按时间段控制传输，在开始下载任务之前应用
+	if scheduleFile := setting.AppSetting.GetScheduleFile(); scheduleFile != "" {
+		rules, err := loadTimeSchedule(scheduleFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("load schedule %s fail, %s", scheduleFile, err.Error()))
+		}
+		filesMgr.timeRules = rules
+		filesMgr.applyTimeSchedule(time.Now())
 	}
 
 	// 1. 加载配置数据库
@@ -43,6 +67,13 @@ func CreateFilesMgr() (*FilesManager, error) {
 		return nil, err
 	}
 
+	// 2. 定时调度排队的下载任务
+	go filesMgr.scheduleLoop()
+	go filesMgr.chokeLoop()
+	if len(filesMgr.timeRules) > 0 {
+		go filesMgr.timeScheduleLoop()
+	}
+
 	// FilesManager{
 	return filesMgr, nil
 }
@@ -54,12 +85,11 @@ func (filesMgr *FilesManager) CreateShareTask(torrent []byte) (string,
 	defer log.EndLog()
 
 	// lock
-	filesMgr.lock.RLock()
+	filesMgr.lock.Lock()
 	// unlock
-	defer filesMgr.lock.RUnlock()
+	defer filesMgr.lock.Unlock()
 
-	fileTasksMgr := FileTasksMgr{lock: sync.RWMutex{}}
-	filesMgr.fileTasksMgr = append(filesMgr.fileTasksMgr, fileTasksMgr)
+	fileTasksMgr := &FileTasksMgr{lock: sync.RWMutex{}}
 	filename, fileMd5, err := fileTasksMgr.CreateShareFile(torrent)
 	if err != nil {
 		log.Err(fmt.Sprintf("Create share file fail, %s", err.Error()))
@@ -71,6 +101,11 @@ func (filesMgr *FilesManager) CreateShareTask(torrent []byte) (string,
 		log.Err(fmt.Sprintf("Add to uvdt data fail, %s", err.Error()))
 		return "", "", err
 	}
+	if err := fileTasksMgr.StartShare(fileMd5); err != nil {
+		log.Err(fmt.Sprintf("Start share task fail, %s", err.Error()))
+		return "", "", err
+	}
+	filesMgr.fileTasksMgr = append(filesMgr.fileTasksMgr, fileTasksMgr)
 	log.Info(fmt.Sprintf("Task %s[%s] started, state: %s",
 		filename,
 		fileMd5,
@@ -81,7 +116,8 @@ func (filesMgr *FilesManager) CreateShareTask(torrent []byte) (string,
 
 func (filesMgr *FilesManager) CreateDownloadTask(
 	destDownloadPath string,
-	torrent []byte) (
+	torrent []byte,
+	sel *FileSelection) (
 	string,
 	string,
 	error) {
@@ -89,12 +125,7 @@ func (filesMgr *FilesManager) CreateDownloadTask(
 	log := logger.NewAgent()
 	defer log.EndLog()
 
-	// lock
-	filesMgr.lock.RLock()
-	// unlock
-	defer filesMgr.lock.RUnlock()
-
-	// 1. 解析元数据
+	// 1. 解析元数据，创建下载文件不持有锁
 	torrContent := make(map[string]interface{})
 	if err := json.Unmarshal(torrent, &torrContent); err != nil {
 		log.Err(fmt.Sprintf("Parse json download torrent data fail"))
@@ -112,13 +143,13 @@ func (filesMgr *FilesManager) CreateDownloadTask(
 		return "", "", errors.New(errMsg)
 	}
 
-	fileTasksMgr := FileTasksMgr{lock: sync.RWMutex{}}
-	filesMgr.fileTasksMgr = append(filesMgr.fileTasksMgr, fileTasksMgr)
+	fileTasksMgr := &FileTasksMgr{lock: sync.RWMutex{}}
 	err := fileTasksMgr.CreateDownloadFile(
 		setting.AppSetting.GetTaskNumForFile(),
 		fileMd5,
 		destDownloadPath,
-		torrent)
+		torrent,
+		sel)
 	if err != nil {
 		log.Err(fmt.Sprintf("Create download file fail, %s", err.Error()))
 		return "", "", err
@@ -129,15 +160,32 @@ func (filesMgr *FilesManager) CreateDownloadTask(
 		log.Err(fmt.Sprintf("Add to uvdt data fail, %s", err.Error()))
 		return "", "", err
 	}
-	log.Info(fmt.Sprintf("Task %s[%s] started, state: %s",
+
+	// 2. 排队等待下载，没有达到同时下载的数量时立即开始
+	if err := fileTasksMgr.Queue(fileMd5); err != nil {
+		log.Err(fmt.Sprintf("Queue download task fail, %s", err.Error()))
+		return "", "", err
+	}
+	filesMgr.lock.Lock()
+	filesMgr.fileTasksMgr = append(filesMgr.fileTasksMgr, fileTasksMgr)
+	starts := filesMgr.schedule()
+	filesMgr.lock.Unlock()
+	log.Info(fmt.Sprintf("Task %s[%s] queued, state: %s",
 		filename,
 		fileMd5,
-		"share"))
+		"downloads"))
+	filesMgr.startTasks(starts)
 
 	return filename, fileMd5, nil
 }
 
-func addToUvdtData(filename string, md5 string, filepath string) error {
+// 保护 uvdt.dat 的读写
+var uvdtDataLock sync.Mutex
+
+/*
+ * 读取 uvdt.dat 共享/下载文件列表，调用方加锁
+ */
+func loadUvdtData() (map[string]interface{}, error) {
 	// 创建日志记录器
 	log := logger.NewAgent()
 	defer log.EndLog()
@@ -148,7 +196,7 @@ func addToUvdtData(filename string, md5 string, filepath string) error {
 	f, err := os.Open(uvdtJsonDataFile)
 	if err != nil {
 		log.Err(fmt.Sprintf("Open uvdt json data fail, %s", err.Error()))
-		return err
+		return nil, err
 	}
 	defer f.Close()
 
@@ -156,7 +204,7 @@ func addToUvdtData(filename string, md5 string, filepath string) error {
 	count, err := f.Read(uvdtData)
 	if err != nil && err != io.EOF {
 		log.Err(fmt.Sprintf("Read uvdt data fail, %s", err.Error()))
-		return err
+		return nil, err
 	}
 	uvdtData = uvdtData[:count]
 
@@ -164,6 +212,38 @@ func addToUvdtData(filename string, md5 string, filepath string) error {
 	jsonMeta := make(map[string]interface{})
 	if err := json.Unmarshal(uvdtData, &jsonMeta); err != nil {
 		log.Err(fmt.Sprintf("Parse json uvdt data fail, %s", err.Error()))
+		return nil, err
+	}
+	return jsonMeta, nil
+}
+
+/*
+ * 保存 uvdt.dat 共享/下载文件列表，调用方加锁
+ */
+func saveUvdtData(jsonMeta map[string]interface{}) error {
+	metaData, err := json.Marshal(jsonMeta)
+	if err != nil {
+		return err
+	}
+
+	uvdtJsonDataFile := path.Join(setting.AppSetting.GetRootPath(), ".uvdt", "uvdt.dat")
+	jsonFile, err := os.OpenFile(uvdtJsonDataFile,
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0644)
+	if err != nil {
+		return err
+	}
+	defer jsonFile.Close()
+	_, err = jsonFile.Write(metaData)
+	return err
+}
+
+func addToUvdtData(filename string, md5 string, filepath string) error {
+	uvdtDataLock.Lock()
+	defer uvdtDataLock.Unlock()
+
+	jsonMeta, err := loadUvdtData()
+	if err != nil {
 		return err
 	}
 	filesMgr.version = jsonMeta["version"].(string)
@@ -191,20 +271,30 @@ func addToUvdtData(filename string, md5 string, filepath string) error {
 	jsonMeta["fileslist"] = filesList
 
 	// 4. 保存共享文件信息
-	metaData, err := json.Marshal(jsonMeta)
+	return saveUvdtData(jsonMeta)
+}
+
+/*
+ * 更新文件的状态: downloads, share
+ */
+func updateUvdtData(md5 string, filepath string) error {
+	uvdtDataLock.Lock()
+	defer uvdtDataLock.Unlock()
+
+	jsonMeta, err := loadUvdtData()
 	if err != nil {
 		return err
 	}
 
-	jsonFile, err := os.OpenFile(uvdtJsonDataFile,
-		os.O_RDWR|os.O_CREATE,
-		0644)
-	defer jsonFile.Close()
-	if err != nil {
-		return err
+	filesList := jsonMeta["fileslist"].([]interface{})
+	for _, v := range filesList {
+		fileInfo := v.(map[string]interface{})
+		if fileInfo["md5"].(string) == md5 {
+			fileInfo["path"] = filepath
+			return saveUvdtData(jsonMeta)
+		}
 	}
-	jsonFile.Write(metaData)
-	return nil
+	return errors.New(fmt.Sprintf("torrent file not exist, %s", md5))
 }
 
 func (filesMgr *FilesManager) GetVersion() string {
@@ -215,10 +305,20 @@ func (filesMgr *FilesManager) GetMaxFileNum() uint {
 	return filesMgr.maxFileNum
 }
 
-func (filesMgr *FilesManager) GetFileTasksMgr() []FileTasksMgr {
+func (filesMgr *FilesManager) GetFileTasksMgr() []*FileTasksMgr {
 	return filesMgr.fileTasksMgr
 }
 
+/*
+ * 根据 infohash 查找文件任务
+ */
+func (filesMgr *FilesManager) GetTask(infoHash string) *FileTasksMgr {
+	filesMgr.lock.RLock()
+	defer filesMgr.lock.RUnlock()
+
+	return filesMgr.findTask(infoHash)
+}
+
 func (filesMgr *FilesManager) GetCurrentFileNum() int {
 	return len(filesMgr.fileTasksMgr)
 }
@@ -228,10 +328,12 @@ func (filesMgr *FilesManager) GetRootPath() string {
 }
 
 func (filesMgr *FilesManager) LoadDB() error {
+	var starts []*FileTasksMgr
+	defer func() { filesMgr.startTasks(starts) }()
 	// lock
-	filesMgr.lock.RLock()
+	filesMgr.lock.Lock()
 	// unlock
-	defer filesMgr.lock.RUnlock()
+	defer filesMgr.lock.Unlock()
 
 	// 创建日志记录器
 	log := logger.NewAgent()
@@ -312,7 +414,7 @@ func (filesMgr *FilesManager) LoadDB() error {
 	filesList := jsonMeta["fileslist"].([]interface{})
 	for _, v := range filesList {
 		fileInfo := v.(map[string]interface{})
-		fileTasksMgr := FileTasksMgr{lock: sync.RWMutex{}}
+		fileTasksMgr := &FileTasksMgr{lock: sync.RWMutex{}}
 		filesMgr.fileTasksMgr = append(filesMgr.fileTasksMgr, fileTasksMgr)
 		filename := fileInfo["filename"].(string)
 		md5 := fileInfo["md5"].(string)
@@ -322,12 +424,15 @@ func (filesMgr *FilesManager) LoadDB() error {
 			md5,
 			filepath))
 		if filepath == "downloads" {
-			fileTasksMgr.Start(int(setting.AppSetting.GetTaskNumForFile()),
-				filename,
-				md5)
+			fileTasksMgr.Queue(md5)
+		} else if filepath == "share" {
+			fileTasksMgr.StartShare(md5)
 		}
 	}
 
+	// 7. 按优先级开始下载任务，解锁后开始
+	starts = filesMgr.schedule()
+
 	return nil
 }
 
@@ -337,21 +442,44 @@ func (filesMgr *FilesManager) GetStats() (map[string]interface{}, error) {
 	// unlock
 	defer filesMgr.lock.RUnlock()
 
+	// 内存使用，单位：字节
+	var memUsed, memLimit int64
+	uploadSlotsUsed, uploadSlotsLimit := nodeUploadSlots.Usage()
+	activeNum := 0
+	waitingNum := 0
+	tasks := []map[string]interface{}{}
+	var downloadSpeed, uploadSpeed int64
+	for _, v := range filesMgr.fileTasksMgr {
+		taskStats := v.GetTaskStats()
+		tasks = append(tasks, taskStats)
+		downloadSpeed += taskStats["download_speed"].(int64)
+		uploadSpeed += taskStats["upload_speed"].(int64)
+
+		used, limit, _ := v.GetMemUsage()
+		memUsed += used
+		memLimit += limit
+		if v.IsDownloading() {
+			activeNum++
+		} else if v.IsQueued() {
+			waitingNum++
+		}
+	}
+
 	stats := map[string]interface{}{
 		"version":      filesMgr.GetVersion(),
 		"root_path":    filesMgr.GetRootPath(),
 		"max_file_num": filesMgr.GetMaxFileNum(),
 		"current_num":  filesMgr.GetCurrentFileNum(),
+		"active_num":   activeNum,
+		"waiting_num":  waitingNum,
+		"paused":       map[string]interface{}{"download": filesMgr.downloadPaused, "upload": filesMgr.uploadPaused},
+		"mem_used":     memUsed,
+		"mem_limit":    memLimit,
+		"upload_slots": map[string]interface{}{"used": uploadSlotsUsed, "limit": uploadSlotsLimit},
+		"download":     downloadSpeed,
+		"upload":       uploadSpeed,
+		"tasks":        tasks, // 共享和下载的文件列表
 	}
 
-	// 输出共享的文件列表
-	/*
-		fileTasksMgr := filesMgr.GetFileTasksMgr()
-		var showFilesList []interface{}
-		for _, v := range fileTasksMgr {
-			showFilesList += v.fileMeta.GetFileTasksStats()
-		}
-	*/
-
 	return stats, nil
 }
@@ -0,0 +1,59 @@
+/*
+	任务内存使用统计，限制下载和上传缓存的数据量
+*/
+
+package nodeserv
+
+import (
+	"sync"
+)
+
+// 任务内存预算，单位：字节
+type MemBudget struct {
+	lock  sync.Mutex
+	limit int64 // 内存上限
+	used  int64 // 已使用的内存
+	peak  int64 // 使用的内存峰值
+}
+
+func NewMemBudget(limit int64) *MemBudget {
+	return &MemBudget{limit: limit}
+}
+
+/*
+ * 申请 n 字节内存，超过上限时返回 false
+ * 没有使用内存时总是允许申请，避免块大小超过上限时任务无法下载
+ */
+func (mb *MemBudget) TryAcquire(n int64) bool {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if mb.used > 0 && mb.used+n > mb.limit {
+		return false
+	}
+	mb.used += n
+	if mb.used > mb.peak {
+		mb.peak = mb.used
+	}
+	return true
+}
+
+func (mb *MemBudget) Release(n int64) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	mb.used -= n
+	if mb.used < 0 {
+		mb.used = 0
+	}
+}
+
+/*
+ * 返回已使用的内存，内存上限，使用的峰值
+ */
+func (mb *MemBudget) Usage() (int64, int64, int64) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	return mb.used, mb.limit, mb.peak
+}
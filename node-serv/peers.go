@@ -0,0 +1,396 @@
+/*
+	peer 列表管理，同一个文件任务的所有 worker 共享
+*/
+
+package nodeserv
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/blueskyz/uvdt/node-serv/setting"
+)
+
+/*
+ * peer 评分
+ * 1. 吞吐量和错误率使用指数移动平均，新的 peer 使用初始吞吐量，保证会被尝试
+ * 2. 连续出错的 peer 暂停使用一段时间
+ * 3. 多次提供 md5 校验失败数据的 peer 禁用一段时间
+ */
+const (
+	PEER_INIT_RATE      = 1 << 20 // 未测量的 peer 初始吞吐量，单位：字节/秒
+	PEER_RATE_ALPHA     = 0.3     // 移动平均的新样本权重
+	PEER_MAX_ERRORS     = 3       // 连续出错次数上限
+	PEER_ERROR_BACKOFF  = 30      // 连续出错后暂停使用的时间，单位秒
+	PEER_MAX_HASH_FAILS = 3       // md5 校验失败次数上限
+	PEER_BAN_TIME       = 600     // md5 校验失败后禁用的时间，单位秒
+)
+
+/*
+ * peer 拥有块的状态
+ */
+const (
+	PB_UNKNOWN = 0  // 未知
+	PB_HAVE    = 1  // 拥有
+	PB_MISSING = -1 // 没有
+)
+
+// peer 信息
+type Peer struct {
+	peerId string // peer id
+	addr   string // ip:port
+	blocks []int8 // 每个块的拥有状态，从下载结果中获知
+
+	rate          float64   // 吞吐量，单位：字节/秒
+	errRate       float64   // 错误率
+	active        int       // 正在进行的请求数量
+	errors        int       // 连续出错次数
+	hashFails     int       // md5 校验失败次数
+	totalDownload int64     // 从该 peer 下载的数据量，单位字节
+	bannedUntil   time.Time // 禁用到期时间
+
+	chokedUntil time.Time // peer 拒绝上传，到期后重试
+
+	syncing   bool      // 正在同步拥有的块
+	syncAfter time.Time // 同步失败后，到期后重新同步
+
+	fromTracker bool      // tracker 返回的 peer
+	pexUntil    time.Time // 交换得到的 peer 的过期时间
+
+	wireAddr string // wire 服务地址 ip:port，从 bitfield 中获知，为空时使用 http
+}
+
+/*
+ * peer 的评分，吞吐量越大，错误率越低，正在进行的请求越少，评分越高
+ */
+func (peer *Peer) score() float64 {
+	return peer.rate * (1 - peer.errRate) / float64(1+peer.active)
+}
+
+/*
+ * peer 是否可以提供块数据，没有明确缺少该块的 peer 都可以尝试
+ */
+func (peer *Peer) mayHave(index int, now time.Time) bool {
+	if now.Before(peer.bannedUntil) || now.Before(peer.chokedUntil) {
+		return false
+	}
+	return index < 0 || index >= len(peer.blocks) || peer.blocks[index] != PB_MISSING
+}
+
+// peer 地址列表
+type Peers struct {
+	lock        sync.RWMutex
+	blockCount  int                  // 文件的块数量
+	peers       map[string]*Peer     // peer_id -> peer
+	pexRequests map[string]time.Time // 交换请求的 peer_id -> 最后请求时间
+}
+
+func NewPeers(blockCount int) *Peers {
+	return &Peers{blockCount: blockCount,
+		peers:       make(map[string]*Peer),
+		pexRequests: make(map[string]time.Time)}
+}
+
+/*
+ * 合并 tracker 返回的 peer 列表: peer_id:ip:port
+ * 1. 新的 peer 以初始评分加入
+ * 2. 已存在的 peer 保留评分，地址变化时更新地址
+ * 3. tracker 不再返回的 peer 从列表中删除，交换得到的 peer 保留到过期
+ * 返回新增和删除的 peer 数量
+ */
+func (ps *Peers) Merge(peerList []string) (int, int) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	selfPeerId := setting.AppSetting.GetPeerId()
+	added := 0
+	seen := make(map[string]bool)
+	for _, v := range peerList {
+		peerId, addr, err := parsePeer(v)
+		if err != nil || peerId == selfPeerId {
+			continue
+		}
+		seen[peerId] = true
+
+		if peer, ok := ps.peers[peerId]; ok {
+			if peer.addr != addr {
+				peer.wireAddr = ""
+			}
+			peer.addr = addr
+			peer.fromTracker = true
+			continue
+		}
+		ps.peers[peerId] = &Peer{peerId: peerId,
+			addr:        addr,
+			blocks:      make([]int8, ps.blockCount),
+			rate:        PEER_INIT_RATE,
+			fromTracker: true}
+		added++
+	}
+
+	now := time.Now()
+	removed := 0
+	for peerId, peer := range ps.peers {
+		if seen[peerId] {
+			continue
+		}
+		peer.fromTracker = false
+		if now.After(peer.pexUntil) {
+			delete(ps.peers, peerId)
+			removed++
+		}
+	}
+	return added, removed
+}
+
+/*
+ * 选择评分最高的可以提供块数据的 peer，并记录一个正在进行的请求
+ * 评分随每次请求变化，每次选择时遍历所有 peer
+ * exclude: 不使用的 peer，子块和 endgame 阶段的请求分散到不同的 peer
+ */
+func (ps *Peers) Pick(index int, exclude map[string]bool) (Peer, error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	now := time.Now()
+	var best *Peer
+	for _, peer := range ps.peers {
+		if !peer.mayHave(index, now) || exclude[peer.peerId] {
+			continue
+		}
+		if best == nil || peer.score() > best.score() {
+			best = peer
+		}
+	}
+	if best == nil {
+		return Peer{}, errors.New("no peer available")
+	}
+	best.active++
+	return *best, nil
+}
+
+/*
+ * 使用指定的 peer，记录一个正在进行的请求
+ */
+func (ps *Peers) Acquire(peerId string) (Peer, error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	peer, ok := ps.peers[peerId]
+	if !ok || !peer.mayHave(-1, time.Now()) {
+		return Peer{}, errors.New("peer not available")
+	}
+	peer.active++
+	return *peer, nil
+}
+
+/*
+ * 请求结束，不记录结果（请求被取消，或 peer 没有该块）
+ */
+func (ps *Peers) Release(peerId string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if peer, ok := ps.peers[peerId]; ok && peer.active > 0 {
+		peer.active--
+	}
+}
+
+/*
+ * 请求结束，记录下载的数据量和时间，更新吞吐量和错误率
+ */
+func (ps *Peers) Record(peerId string, bytes int, cost time.Duration, succ bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	peer, ok := ps.peers[peerId]
+	if !ok {
+		return
+	}
+	if peer.active > 0 {
+		peer.active--
+	}
+
+	if succ {
+		peer.errors = 0
+		peer.errRate = (1 - PEER_RATE_ALPHA) * peer.errRate
+		peer.totalDownload += int64(bytes)
+		if cost > 0 {
+			sample := float64(bytes) / cost.Seconds()
+			peer.rate = (1-PEER_RATE_ALPHA)*peer.rate + PEER_RATE_ALPHA*sample
+		}
+		return
+	}
+
+	peer.errors++
+	peer.errRate = (1-PEER_RATE_ALPHA)*peer.errRate + PEER_RATE_ALPHA
+	if peer.errors >= PEER_MAX_ERRORS {
+		peer.errors = 0
+		peer.bannedUntil = time.Now().Add(PEER_ERROR_BACKOFF * time.Second)
+	}
+}
+
+/*
+ * peer 提供的数据 md5 校验失败，多次失败后禁用
+ */
+func (ps *Peers) HashFail(peerId string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	peer, ok := ps.peers[peerId]
+	if !ok {
+		return
+	}
+	peer.hashFails++
+	peer.errRate = (1-PEER_RATE_ALPHA)*peer.errRate + PEER_RATE_ALPHA
+	if peer.hashFails >= PEER_MAX_HASH_FAILS {
+		peer.hashFails = 0
+		peer.bannedUntil = time.Now().Add(PEER_BAN_TIME * time.Second)
+	}
+}
+
+/*
+ * peer 拒绝上传，retryAfter 之内不向该 peer 请求
+ */
+func (ps *Peers) Choke(peerId string, retryAfter time.Duration) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if peer, ok := ps.peers[peerId]; ok {
+		peer.chokedUntil = time.Now().Add(retryAfter)
+	}
+}
+
+/*
+ * peer 向本节点上传的速度，没有从该 peer 下载过时为 0
+ */
+func (ps *Peers) Reciprocity(peerId string) float64 {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	peer, ok := ps.peers[peerId]
+	if !ok || peer.totalDownload == 0 {
+		return 0
+	}
+	return peer.rate
+}
+
+/*
+ * 记录 peer 是否拥有块
+ */
+func (ps *Peers) SetBlock(peerId string, index int, stat int8) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	peer, ok := ps.peers[peerId]
+	if !ok || index < 0 || index >= len(peer.blocks) {
+		return
+	}
+	peer.blocks[index] = stat
+}
+
+/*
+ * 统计每个块可以从多少个 peer 获取，用于最少优先（rarest first）选择块
+ * 返回明确拥有该块的 peer 数量和状态未知的 peer 数量，
+ * 交换 bitfield 之前所有块都是未知状态，只有返回 404 的 peer 会减少块的可获取数量
+ */
+func (ps *Peers) Availability() ([]int, []int) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	now := time.Now()
+	have := make([]int, ps.blockCount)
+	unknown := make([]int, ps.blockCount)
+	for _, peer := range ps.peers {
+		for i := range have {
+			if !peer.mayHave(i, now) {
+				continue
+			}
+			if i < len(peer.blocks) && peer.blocks[i] == PB_HAVE {
+				have[i]++
+			} else {
+				unknown[i]++
+			}
+		}
+	}
+	return have, unknown
+}
+
+/*
+ * 记录 peer 的 bitfield，拥有的块以外都是没有的块
+ */
+func (ps *Peers) SetBitfield(peerId string, have []bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	peer, ok := ps.peers[peerId]
+	if !ok {
+		return
+	}
+	for i := range peer.blocks {
+		if i < len(have) && have[i] {
+			peer.blocks[i] = PB_HAVE
+		} else {
+			peer.blocks[i] = PB_MISSING
+		}
+	}
+}
+
+/*
+ * 选择需要同步拥有的块的 peer，标记为同步中，返回 peer_id -> ip:port
+ */
+func (ps *Peers) BeginSync(now time.Time) map[string]string {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	peers := make(map[string]string)
+	for _, peer := range ps.peers {
+		if peer.syncing || now.Before(peer.syncAfter) {
+			continue
+		}
+		peer.syncing = true
+		peers[peer.peerId] = peer.addr
+	}
+	return peers
+}
+
+/*
+ * 同步结束，稍后重新同步
+ */
+func (ps *Peers) EndSync(peerId string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if peer, ok := ps.peers[peerId]; ok {
+		peer.syncing = false
+		peer.syncAfter = time.Now().Add(PEER_SYNC_BACKOFF * time.Second)
+	}
+}
+
+/*
+ * 记录 peer 的 wire 服务地址，为空时只使用 http
+ */
+func (ps *Peers) SetWireAddr(peerId string, addr string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if peer, ok := ps.peers[peerId]; ok {
+		peer.wireAddr = addr
+	}
+}
+
+func (ps *Peers) Has(peerId string) bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	_, ok := ps.peers[peerId]
+	return ok
+}
+
+func (ps *Peers) Count() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(ps.peers)
+}
@@ -0,0 +1,228 @@
+/*
+	peer exchange，节点之间交换已知的 peer 列表，tracker 不可用时 swarm 仍然可以扩展
+	1. 请求方的地址加入被请求方的 peer 列表
+	2. 交换得到的 peer 有过期时间，tracker 不再返回时保留到过期
+	3. 限制返回的 peer 数量，同一个 peer 的请求频率，以及交换加入的 peer 总数
+*/
+
+package nodeserv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/blueskyz/uvdt/logger"
+	"github.com/blueskyz/uvdt/node-serv/setting"
+)
+
+const (
+	PEX_INTERVAL        = 60  // 交换间隔，单位秒
+	PEX_MIN_INTERVAL    = 30  // 同一个 peer 两次请求的最小间隔，单位秒
+	PEX_FANOUT          = 3   // 每次交换请求的 peer 数量
+	PEX_MAX_PEERS       = 50  // 每次交换返回和接受的最大 peer 数量
+	PEX_MAX_TOTAL_PEERS = 200 // 交换加入后 peer 列表的最大数量
+	PEX_PEER_TTL        = 600 // 交换得到的 peer 的过期时间，单位秒
+)
+
+// 请求过于频繁
+var ErrPexTooFrequent = errors.New("pex too frequent")
+
+/*
+ * 合并交换得到的 peer 列表: peer_id:ip:port
+ * 1. 新的 peer 以初始评分加入，peer 列表达到上限时不再加入
+ * 2. 已存在的 peer 延长过期时间
+ * 返回新增的 peer 数量
+ */
+func (ps *Peers) MergePex(peerList []string) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	selfPeerId := setting.AppSetting.GetPeerId()
+	expire := time.Now().Add(PEX_PEER_TTL * time.Second)
+	added := 0
+	for i, v := range peerList {
+		if i >= PEX_MAX_PEERS {
+			break
+		}
+		peerId, addr, err := parsePeer(v)
+		if err != nil || peerId == selfPeerId || peerId == WEB_SEED_PEER_ID {
+			continue
+		}
+		if peer, ok := ps.peers[peerId]; ok {
+			if expire.After(peer.pexUntil) {
+				peer.pexUntil = expire
+			}
+			continue
+		}
+		if len(ps.peers) >= PEX_MAX_TOTAL_PEERS {
+			continue
+		}
+		ps.peers[peerId] = &Peer{peerId: peerId,
+			addr:     addr,
+			blocks:   make([]int8, ps.blockCount),
+			rate:     PEER_INIT_RATE,
+			pexUntil: expire}
+		added++
+	}
+	return added
+}
+
+/*
+ * 删除 tracker 没有返回并且交换已过期的 peer
+ */
+func (ps *Peers) ExpirePex(now time.Time) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	removed := 0
+	for peerId, peer := range ps.peers {
+		if !peer.fromTracker && now.After(peer.pexUntil) {
+			delete(ps.peers, peerId)
+			removed++
+		}
+	}
+	return removed
+}
+
+/*
+ * 提供给其他 peer 的 peer 列表，随机选择最多 PEX_MAX_PEERS 个，不包括禁用的 peer 和请求方
+ */
+func (ps *Peers) PexList(exclude string) []string {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	now := time.Now()
+	peerList := []string{}
+	for _, peer := range ps.peers {
+		if peer.peerId == exclude || now.Before(peer.bannedUntil) {
+			continue
+		}
+		peerList = append(peerList, fmt.Sprintf("%s:%s", peer.peerId, peer.addr))
+	}
+	rand.Shuffle(len(peerList), func(i, j int) {
+		peerList[i], peerList[j] = peerList[j], peerList[i]
+	})
+	if len(peerList) > PEX_MAX_PEERS {
+		peerList = peerList[:PEX_MAX_PEERS]
+	}
+	return peerList
+}
+
+/*
+ * 记录 peer 的交换请求，间隔小于 PEX_MIN_INTERVAL 时返回 false
+ */
+func (ps *Peers) allowPex(peerId string, now time.Time) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if lasttime, ok := ps.pexRequests[peerId]; ok && now.Sub(lasttime) < PEX_MIN_INTERVAL*time.Second {
+		return false
+	}
+	for k, v := range ps.pexRequests {
+		if now.Sub(v) >= PEX_MIN_INTERVAL*time.Second {
+			delete(ps.pexRequests, k)
+		}
+	}
+	ps.pexRequests[peerId] = now
+	return true
+}
+
+/*
+ * 处理 peer 的交换请求，请求方加入 peer 列表，返回已知的 peer 列表
+ * addr: 请求方的 bt 服务地址 ip:port，为空时不加入
+ */
+func (ftMgr *FileTasksMgr) ExchangePeers(peerId string, addr string) ([]string, error) {
+	ftMgr.lock.RLock()
+	peers := ftMgr.peers
+	stat := ftMgr.stat
+	ftMgr.lock.RUnlock()
+
+	if peers == nil || (stat != FM_DOWNLOAD && stat != FM_SHARE) {
+		return nil, errors.New("task not started")
+	}
+	if !peers.allowPex(peerId, time.Now()) {
+		return nil, ErrPexTooFrequent
+	}
+	if addr != "" {
+		peers.MergePex([]string{fmt.Sprintf("%s:%s", peerId, addr)})
+	}
+	return peers.PexList(peerId), nil
+}
+
+/*
+ * 向 peer 请求交换 peer 列表
+ */
+func (ftMgr *FileTasksMgr) requestPex(ctx context.Context, addr string) ([]string, error) {
+	url := fmt.Sprintf("http://%s/api/resource/pex?infohash=%s&peer_id=%s&port=%d",
+		addr,
+		ftMgr.fileMeta.fileMd5,
+		setting.AppSetting.GetPeerId(),
+		setting.AppSetting.GetBtServ().Port)
+	result, err := getPeerResult(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	peerList := []string{}
+	if peers, ok := result["peers"].([]interface{}); ok {
+		for _, v := range peers {
+			if peer, ok := v.(string); ok {
+				peerList = append(peerList, peer)
+			}
+		}
+	}
+	return peerList, nil
+}
+
+/*
+ * 下载中定时向随机的几个 peer 交换 peer 列表，删除过期的 peer
+ */
+func (ftMgr *FileTasksMgr) pexLoop(stop chan bool) {
+	ftMgr.lock.RLock()
+	ctx, cancel := context.WithCancel(ftMgr.ctx)
+	peers := ftMgr.peers
+	ftMgr.lock.RUnlock()
+	defer cancel()
+
+	for {
+		select {
+		case <-time.After(PEX_INTERVAL * time.Second):
+		case _ = <-stop:
+			return
+		}
+		if !ftMgr.IsDownloading() {
+			return
+		}
+
+		log := logger.NewAgent()
+		added := 0
+		targets := peers.PexList("")
+		if len(targets) > PEX_FANOUT {
+			targets = targets[:PEX_FANOUT]
+		}
+		for _, v := range targets {
+			_, addr, err := parsePeer(v)
+			if err != nil {
+				continue
+			}
+			reqCtx, reqCancel := context.WithTimeout(ctx, PEER_RESPONSE_TIMEOUT*time.Second)
+			peerList, err := ftMgr.requestPex(reqCtx, addr)
+			reqCancel()
+			if err != nil {
+				log.Err(fmt.Sprintf("Exchange peers with %s fail, %s", addr, err.Error()))
+				continue
+			}
+			added += peers.MergePex(peerList)
+		}
+		removed := peers.ExpirePex(time.Now())
+		log.Info(fmt.Sprintf("Exchange peers %s, added: %d, expired: %d, total: %d",
+			ftMgr.fileMeta.fileMd5,
+			added,
+			removed,
+			peers.Count()))
+		log.EndLog()
+	}
+}
@@ -0,0 +1,174 @@
+/*
+	令牌桶限速，分为节点全局和每个任务，下载和上传分别限速
+*/
+
+package nodeserv
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// 每次读写的最大长度，使限速更平滑
+const RATE_LIMIT_CHUNK = 32 << 10
+
+// 节点全局的下载，上传限速，启动时根据配置设置速度
+var (
+	downloadLimiter = NewRateLimiter(0)
+	uploadLimiter   = NewRateLimiter(0)
+)
+
+// 令牌桶，桶的容量为 1 秒的流量
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   int64 // 每秒字节数，0: 不限速
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func (rl *RateLimiter) SetRate(rate int64) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	rl.rate = rate
+	if rl.tokens > float64(rate) {
+		rl.tokens = float64(rate)
+	}
+}
+
+func (rl *RateLimiter) GetRate() int64 {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	return rl.rate
+}
+
+/*
+ * 获取 n 个字节的令牌，令牌不足时等待，ctx 取消时返回错误
+ */
+func (rl *RateLimiter) Wait(ctx context.Context, n int) error {
+	rl.lock.Lock()
+	if rl.rate <= 0 {
+		rl.lock.Unlock()
+		return nil
+	}
+
+	// 1. 按时间补充令牌
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * float64(rl.rate)
+	if rl.tokens > float64(rl.rate) {
+		rl.tokens = float64(rl.rate)
+	}
+	rl.last = now
+
+	// 2. 预支令牌，不足的部分等待补充
+	rl.tokens -= float64(n)
+	var wait time.Duration
+	if rl.tokens < 0 {
+		wait = time.Duration(-rl.tokens / float64(rl.rate) * float64(time.Second))
+	}
+	rl.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 下载进度，worker 用来检查下载阻塞
+type transferProgress interface {
+	touch()     // 收到数据
+	beginWait() // 开始等待限速，等待期间不算阻塞
+	endWait()   // 等待限速结束
+}
+
+/*
+ * 获取所有限速器的 n 个字节的令牌，progress 为空时不记录进度
+ */
+func waitLimiters(ctx context.Context, n int, progress transferProgress, limiters []*RateLimiter) error {
+	if progress != nil {
+		progress.beginWait()
+		defer progress.endWait()
+	}
+	for _, limiter := range limiters {
+		if err := limiter.Wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 限速读取
+type rateLimitedReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	progress transferProgress
+	limiters []*RateLimiter
+}
+
+func newRateLimitedReader(ctx context.Context,
+	reader io.Reader,
+	progress transferProgress,
+	limiters ...*RateLimiter) io.Reader {
+	return &rateLimitedReader{ctx: ctx, reader: reader, progress: progress, limiters: limiters}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > RATE_LIMIT_CHUNK {
+		p = p[:RATE_LIMIT_CHUNK]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 && r.progress != nil {
+		r.progress.touch()
+	}
+	if waitErr := waitLimiters(r.ctx, n, r.progress, r.limiters); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+// 限速写入
+type rateLimitedWriter struct {
+	ctx      context.Context
+	writer   io.Writer
+	limiters []*RateLimiter
+}
+
+func newRateLimitedWriter(ctx context.Context,
+	writer io.Writer,
+	limiters ...*RateLimiter) io.Writer {
+	return &rateLimitedWriter{ctx: ctx, writer: writer, limiters: limiters}
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > RATE_LIMIT_CHUNK {
+			chunk = chunk[:RATE_LIMIT_CHUNK]
+		}
+		for _, limiter := range w.limiters {
+			if err := limiter.Wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
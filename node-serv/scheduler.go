@@ -0,0 +1,191 @@
+/*
+	下载任务调度，限制同时下载的任务数量，超过的任务按优先级排队等待
+*/
+
+package nodeserv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/blueskyz/uvdt/logger"
+	"github.com/blueskyz/uvdt/node-serv/setting"
+)
+
+/*
+ * 调度检查间隔，单位秒，下载完成或停止的任务释放的位置由排队的任务使用
+ * 开始失败的任务重新排队，等待时间按失败次数倍增，不超过 SCHEDULE_MAX_BACKOFF
+ */
+const (
+	SCHEDULE_INTERVAL    = 5
+	SCHEDULE_BACKOFF     = 30
+	SCHEDULE_MAX_BACKOFF = 600
+)
+
+/*
+ * 选择排队的下载任务，调用方加锁，返回的任务由调用方解锁后调用 startTasks 开始
+ * 1. 同时下载的任务不超过 maxFileNum，正在开始的任务也占用下载数量
+ * 2. 排队的任务按优先级从高到低开始下载，优先级相同时先添加的先开始
+ * 3. 时间表暂停下载时不开始新的任务
+ * 4. 开始失败等待重试的任务不选择
+ */
+func (filesMgr *FilesManager) schedule() []*FileTasksMgr {
+	// 时间表暂停下载
+	if filesMgr.downloadPaused {
+		return nil
+	}
+
+	now := time.Now()
+	active := 0
+	waiting := []*FileTasksMgr{}
+	for _, v := range filesMgr.fileTasksMgr {
+		if v.IsDownloading() || v.IsStarting() {
+			active++
+		} else if v.IsQueued() && v.canRetryStart(now) {
+			waiting = append(waiting, v)
+		}
+	}
+	sort.SliceStable(waiting, func(i, j int) bool {
+		return waiting[i].GetPriority() > waiting[j].GetPriority()
+	})
+
+	starts := []*FileTasksMgr{}
+	for _, v := range waiting {
+		if uint(active) >= filesMgr.maxFileNum {
+			break
+		}
+		v.setStarting(true)
+		starts = append(starts, v)
+		active++
+	}
+	return starts
+}
+
+/*
+ * 开始 schedule 选择的任务，调用方不能持有 FilesManager 的锁，检查本地块需要读取整个文件
+ * 开始失败的任务重新排队，等待一段时间后重试
+ */
+func (filesMgr *FilesManager) startTasks(tasks []*FileTasksMgr) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	for _, v := range tasks {
+		err := v.Start(setting.AppSetting.GetTaskNumForFile(),
+			v.GetFileName(),
+			v.GetInfoHash())
+		if err != nil {
+			backoff := v.requeueAfterFail(err, time.Now())
+			log.Err(fmt.Sprintf("Start task %s fail, retry after %v, %s",
+				v.GetInfoHash(),
+				backoff,
+				err.Error()))
+		} else {
+			log.Info(fmt.Sprintf("Task %s[%s] started",
+				v.GetFileName(),
+				v.GetInfoHash()))
+		}
+		v.setStarting(false)
+	}
+}
+
+/*
+ * 开始失败的任务是否已经等待到期
+ */
+func (ftMgr *FileTasksMgr) canRetryStart(now time.Time) bool {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return !now.Before(ftMgr.retryAfter)
+}
+
+/*
+ * 开始失败，记录原因，重新排队，返回等待时间
+ */
+func (ftMgr *FileTasksMgr) requeueAfterFail(err error, now time.Time) time.Duration {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	ftMgr.startErr = err.Error()
+	ftMgr.startFails++
+	backoff := SCHEDULE_MAX_BACKOFF * time.Second
+	if ftMgr.startFails <= 5 {
+		backoff = SCHEDULE_BACKOFF * time.Second << uint(ftMgr.startFails-1)
+		if backoff > SCHEDULE_MAX_BACKOFF*time.Second {
+			backoff = SCHEDULE_MAX_BACKOFF * time.Second
+		}
+	}
+	ftMgr.retryAfter = now.Add(backoff)
+	ftMgr.queued = true
+	ftMgr.stat = FM_PAUSE
+	return backoff
+}
+
+/*
+ * 定时调度排队的下载任务
+ */
+func (filesMgr *FilesManager) scheduleLoop() {
+	for {
+		time.Sleep(SCHEDULE_INTERVAL * time.Second)
+
+		filesMgr.lock.Lock()
+		starts := filesMgr.schedule()
+		filesMgr.lock.Unlock()
+		filesMgr.startTasks(starts)
+	}
+}
+
+/*
+ * 根据 infohash 查找文件任务，调用方加锁
+ */
+func (filesMgr *FilesManager) findTask(infoHash string) *FileTasksMgr {
+	for _, v := range filesMgr.fileTasksMgr {
+		if v.GetInfoHash() == infoHash {
+			return v
+		}
+	}
+	return nil
+}
+
+/*
+ * 设置任务的优先级，排队的任务按优先级开始下载
+ */
+func (filesMgr *FilesManager) SetTaskPriority(infoHash string, priority int) error {
+	filesMgr.lock.Lock()
+	defer filesMgr.lock.Unlock()
+
+	ftMgr := filesMgr.findTask(infoHash)
+	if ftMgr == nil {
+		return errors.New(fmt.Sprintf("task not exist, %s", infoHash))
+	}
+	return ftMgr.SetPriority(priority)
+}
+
+/*
+ * 把任务移动到排队的最前面，优先级设置为比其他排队任务都高
+ * 返回新的优先级
+ */
+func (filesMgr *FilesManager) MoveTaskToFront(infoHash string) (int, error) {
+	filesMgr.lock.Lock()
+	defer filesMgr.lock.Unlock()
+
+	ftMgr := filesMgr.findTask(infoHash)
+	if ftMgr == nil {
+		return 0, errors.New(fmt.Sprintf("task not exist, %s", infoHash))
+	}
+	if !ftMgr.IsQueued() {
+		return 0, errors.New(fmt.Sprintf("task is not queued, %s", infoHash))
+	}
+
+	priority := ftMgr.GetPriority()
+	for _, v := range filesMgr.fileTasksMgr {
+		if v != ftMgr && v.IsQueued() && v.GetPriority() >= priority {
+			priority = v.GetPriority() + 1
+		}
+	}
+	if err := ftMgr.SetPriority(priority); err != nil {
+		return 0, err
+	}
+	return priority, nil
+}
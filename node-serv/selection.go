@@ -0,0 +1,315 @@
+/*
+	多文件种子的文件选择，只下载选择的文件需要的块
+
+	下载参数:
+	include: 只下载匹配的文件，多个用逗号分隔，例如: include=docs/,*.mp4
+	exclude: 不下载匹配的文件，例如: exclude=samples/
+	priority: 文件的下载优先级，例如: priority=a/b.mp4:high,samples/:skip
+	匹配规则: 相同路径，目录前缀（以 / 结尾或者完整的目录名），或者 path.Match 通配符，
+	不包含目录的通配符匹配文件名
+*/
+
+package nodeserv
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/blueskyz/uvdt/logger"
+)
+
+/*
+ * 文件下载优先级，块的优先级为包含该块的文件的最高优先级
+ */
+const (
+	FP_SKIP   = -1 // 不下载
+	FP_NORMAL = 0  // 正常下载
+	FP_HIGH   = 1  // 优先下载
+)
+
+var filePriorityNames = map[string]int{
+	"skip":   FP_SKIP,
+	"normal": FP_NORMAL,
+	"high":   FP_HIGH,
+}
+
+// 文件优先级规则
+type filePriorityRule struct {
+	pattern  string
+	priority int
+}
+
+// 文件选择
+type FileSelection struct {
+	include    []string           // 只下载匹配的文件
+	exclude    []string           // 不下载匹配的文件
+	priorities []filePriorityRule // 按顺序设置匹配文件的优先级
+}
+
+func splitPatterns(value string) []string {
+	patterns := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			patterns = append(patterns, v)
+		}
+	}
+	return patterns
+}
+
+/*
+ * 从请求参数中解析文件选择，没有选择参数时返回 nil
+ */
+func parseFileSelection(values url.Values) (*FileSelection, error) {
+	sel := &FileSelection{include: splitPatterns(values.Get("include")),
+		exclude: splitPatterns(values.Get("exclude"))}
+
+	for _, v := range splitPatterns(values.Get("priority")) {
+		i := strings.LastIndex(v, ":")
+		if i <= 0 {
+			return nil, errors.New(fmt.Sprintf("file priority format err, %s", v))
+		}
+		priority, ok := filePriorityNames[v[i+1:]]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("file priority err, %s", v))
+		}
+		sel.priorities = append(sel.priorities, filePriorityRule{pattern: v[:i], priority: priority})
+	}
+
+	if len(sel.include) == 0 && len(sel.exclude) == 0 && len(sel.priorities) == 0 {
+		return nil, nil
+	}
+	return sel, nil
+}
+
+/*
+ * 文件路径是否匹配
+ */
+func matchFile(pattern string, filePath string) bool {
+	dir := strings.HasSuffix(pattern, "/")
+	pattern = path.Clean(pattern)
+	if pattern == filePath || strings.HasPrefix(filePath, pattern+"/") {
+		return true
+	}
+	if dir {
+		return false
+	}
+	if ok, _ := path.Match(pattern, filePath); ok {
+		return true
+	}
+	// 不包含目录的通配符匹配文件名
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(filePath))
+		return ok
+	}
+	return false
+}
+
+func matchAny(patterns []string, filePath string) bool {
+	for _, v := range patterns {
+		if matchFile(v, filePath) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * 设置文件选择，替换原来的选择，没有选择任何文件时返回错误
+ * 1. 有 include 时只下载匹配的文件
+ * 2. 不下载匹配 exclude 的文件
+ * 3. 按顺序设置匹配 priority 的文件优先级
+ */
+func (fileMeta *FileMeta) applySelection(sel *FileSelection) error {
+	if sel == nil {
+		sel = &FileSelection{}
+	}
+	if fileMeta.contenttype != CT_MULTIFILE {
+		if len(sel.include) > 0 || len(sel.exclude) > 0 || len(sel.priorities) > 0 {
+			return errors.New("file selection only for multifile")
+		}
+		return nil
+	}
+
+	priorities := make([]int, len(fileMeta.files))
+	selected := 0
+	for i, v := range fileMeta.files {
+		priorities[i] = FP_NORMAL
+		if len(sel.include) > 0 && !matchAny(sel.include, v.path) {
+			priorities[i] = FP_SKIP
+		}
+		if matchAny(sel.exclude, v.path) {
+			priorities[i] = FP_SKIP
+		}
+		for _, rule := range sel.priorities {
+			if matchFile(rule.pattern, v.path) {
+				priorities[i] = rule.priority
+			}
+		}
+		if priorities[i] != FP_SKIP {
+			selected++
+		}
+	}
+	if selected == 0 {
+		return errors.New("no file selected")
+	}
+
+	for i := range fileMeta.files {
+		fileMeta.files[i].priority = priorities[i]
+	}
+	fileMeta.updateBlockPriorities()
+	return nil
+}
+
+/*
+ * 从元数据中加载文件的下载优先级，与文件列表的顺序一致
+ */
+func (fileMeta *FileMeta) loadFilePriorities(content map[string]interface{}) {
+	files, _ := content["files"].([]interface{})
+	for i, v := range files {
+		if i >= len(fileMeta.files) {
+			break
+		}
+		item, _ := v.(map[string]interface{})
+		if priority, ok := item["priority"].(float64); ok &&
+			int(priority) >= FP_SKIP && int(priority) <= FP_HIGH {
+			fileMeta.files[i].priority = int(priority)
+		}
+	}
+}
+
+/*
+ * 根据文件的优先级计算块的优先级，块可能跨越多个文件，使用最高的优先级
+ */
+func (fileMeta *FileMeta) updateBlockPriorities() {
+	if fileMeta.contenttype != CT_MULTIFILE || fileMeta.blockSize <= 0 {
+		for i := range fileMeta.blocks {
+			fileMeta.blocks[i].priority = FP_NORMAL
+		}
+		return
+	}
+
+	for i := range fileMeta.blocks {
+		fileMeta.blocks[i].priority = FP_SKIP
+	}
+	for _, v := range fileMeta.files {
+		if v.size == 0 {
+			continue
+		}
+		first := int(v.offset / int64(fileMeta.blockSize))
+		last := int((v.offset + v.size - 1) / int64(fileMeta.blockSize))
+		for i := first; i <= last && i < len(fileMeta.blocks); i++ {
+			if v.priority > fileMeta.blocks[i].priority {
+				fileMeta.blocks[i].priority = v.priority
+			}
+		}
+	}
+}
+
+/*
+ * 文件列表和下载优先级
+ */
+func (fileMeta *FileMeta) selectedFiles() []map[string]interface{} {
+	names := make(map[int]string)
+	for k, v := range filePriorityNames {
+		names[v] = k
+	}
+
+	files := []map[string]interface{}{}
+	for _, v := range fileMeta.files {
+		files = append(files, map[string]interface{}{
+			"path":     v.path,
+			"size":     v.size,
+			"priority": names[v.priority],
+		})
+	}
+	return files
+}
+
+/*
+ * 设置下载任务的文件选择，保存到元数据
+ * 返回是否还有需要下载的块
+ */
+func (ftMgr *FileTasksMgr) SetFileSelection(sel *FileSelection) (bool, error) {
+	ftMgr.lock.Lock()
+	defer ftMgr.lock.Unlock()
+
+	if err := ftMgr.fileMeta.applySelection(sel); err != nil {
+		return false, err
+	}
+	if err := ftMgr.fileMeta.SaveMetaFile(ftMgr.fileMeta.fileMd5); err != nil {
+		return false, err
+	}
+	return !ftMgr.selectedComplete(), nil
+}
+
+/*
+ * 文件列表和下载优先级
+ */
+func (ftMgr *FileTasksMgr) GetFiles() []map[string]interface{} {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return ftMgr.fileMeta.selectedFiles()
+}
+
+/*
+ * 选择的文件需要的块是否都已下载完成，调用方加锁
+ */
+func (ftMgr *FileTasksMgr) selectedComplete() bool {
+	for _, block := range ftMgr.fileMeta.blocks {
+		if block.priority != FP_SKIP && block.blockStat != BS_COMPLETE {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * 是否所有块都已下载完成，调用方加锁
+ */
+func (ftMgr *FileTasksMgr) allComplete() bool {
+	for _, block := range ftMgr.fileMeta.blocks {
+		if block.blockStat != BS_COMPLETE {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * 设置任务的文件选择
+ * 部分下载完成已转为分享的任务，选择了新的文件时重新排队下载
+ */
+func (filesMgr *FilesManager) SetTaskFiles(infoHash string, sel *FileSelection) error {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	// 解锁后开始调度选择的任务
+	var starts []*FileTasksMgr
+	defer func() { filesMgr.startTasks(starts) }()
+	filesMgr.lock.Lock()
+	defer filesMgr.lock.Unlock()
+
+	ftMgr := filesMgr.findTask(infoHash)
+	if ftMgr == nil {
+		return errors.New(fmt.Sprintf("task not exist, %s", infoHash))
+	}
+	needDownload, err := ftMgr.SetFileSelection(sel)
+	if err != nil {
+		return err
+	}
+	if !needDownload || ftMgr.GetStat() != FM_SHARE {
+		return nil
+	}
+
+	log.Info(fmt.Sprintf("Task %s selected more files, download again", infoHash))
+	ftMgr.Stop()
+	if err := ftMgr.Queue(infoHash); err != nil {
+		return err
+	}
+	starts = filesMgr.schedule()
+	return nil
+}
@@ -25,20 +25,38 @@ type Setting struct {
 
 	httpServ    Serv
 	btServ      Serv
+	wireServ    Serv // 端口为 0 时不启动
 	trackerServ Serv
 
 	maxFileNum    uint // 并行管理的可以上传下载的文件数量，每个任务对应一个文件
 	maxTaskNum    int  // 下载单个文件对应的协程数量
 	maxMemPerTask uint // 每个上传下载任务可以使用的内存大小，单位：M
+
+	// 限速，单位：KB/s，0: 不限速
+	maxDownloadRate     int // 节点下载速度
+	maxUploadRate       int // 节点上传速度
+	maxTaskDownloadRate int // 每个任务的下载速度
+	maxTaskUploadRate   int // 每个任务的上传速度
+
+	scheduleFile string // 按时间段控制传输的时间表文件
+
+	// 同时上传的 peer 数量，0: 不限制
+	uploadSlots     int // 每个任务
+	nodeUploadSlots int // 节点
+
+	transport string // 下载使用的传输方式: wire, http
 }
 
 var AppSetting Setting
 
 func init() {
 	AppSetting = Setting{
-		maxFileNum:    128,
-		maxTaskNum:    32,
-		maxMemPerTask: 32}
+		maxFileNum:      128,
+		maxTaskNum:      32,
+		maxMemPerTask:   32,
+		uploadSlots:     4,
+		nodeUploadSlots: 16,
+		transport:       "http"}
 }
 
 // root 目录
@@ -66,6 +84,10 @@ func (set *Setting) GetLogFile() string {
 	return set.logFile
 }
 
+func (set *Setting) SetMaxFileNum(maxFileNum uint) {
+	set.maxFileNum = maxFileNum
+}
+
 func (set *Setting) GetMaxFileNum() uint {
 	return set.maxFileNum
 }
@@ -78,6 +100,78 @@ func (set *Setting) GetMaxMemPerFile() uint {
 	return set.maxMemPerTask
 }
 
+// 设置限速，单位：KB/s
+func (set *Setting) SetDownloadRate(rate int) {
+	set.maxDownloadRate = rate
+}
+
+func (set *Setting) GetDownloadRate() int {
+	return set.maxDownloadRate
+}
+
+func (set *Setting) SetUploadRate(rate int) {
+	set.maxUploadRate = rate
+}
+
+func (set *Setting) GetUploadRate() int {
+	return set.maxUploadRate
+}
+
+func (set *Setting) SetTaskDownloadRate(rate int) {
+	set.maxTaskDownloadRate = rate
+}
+
+func (set *Setting) GetTaskDownloadRate() int {
+	return set.maxTaskDownloadRate
+}
+
+func (set *Setting) SetTaskUploadRate(rate int) {
+	set.maxTaskUploadRate = rate
+}
+
+func (set *Setting) GetTaskUploadRate() int {
+	return set.maxTaskUploadRate
+}
+
+// 时间表文件，按时间段设置限速，暂停下载和上传
+func (set *Setting) SetScheduleFile(scheduleFile string) {
+	set.scheduleFile = scheduleFile
+}
+
+func (set *Setting) GetScheduleFile() string {
+	return set.scheduleFile
+}
+
+// 同时上传的 peer 数量
+func (set *Setting) SetUploadSlots(slots int) {
+	set.uploadSlots = slots
+}
+
+func (set *Setting) GetUploadSlots() int {
+	return set.uploadSlots
+}
+
+func (set *Setting) SetNodeUploadSlots(slots int) {
+	set.nodeUploadSlots = slots
+}
+
+func (set *Setting) GetNodeUploadSlots() int {
+	return set.nodeUploadSlots
+}
+
+// 下载使用的传输方式，wire: peer 支持时使用 tcp 长连接，http: 只使用 http
+func (set *Setting) SetTransport(transport string) error {
+	if transport != "wire" && transport != "http" {
+		return errors.New(fmt.Sprintf("Transport err, %s", transport))
+	}
+	set.transport = transport
+	return nil
+}
+
+func (set *Setting) GetTransport() string {
+	return set.transport
+}
+
 // 设置 http server
 func (set *Setting) SetHttpServ(value string) error {
 	httpServ, err := str2Serv(value)
@@ -104,6 +198,23 @@ func (set *Setting) GetBtServ() Serv {
 	return set.btServ
 }
 
+// 设置 bt wire server，为空时不启动
+func (set *Setting) SetWireServ(value string) error {
+	if len(value) == 0 {
+		set.wireServ = Serv{}
+		return nil
+	}
+	wireServ, err := str2Serv(value)
+	if err == nil {
+		set.wireServ = wireServ
+	}
+	return err
+}
+
+func (set *Setting) GetWireServ() Serv {
+	return set.wireServ
+}
+
 // 设置 trace server
 func (set *Setting) SetTraceServ(value string) error {
 	trackerServ, err := str2Serv(value)
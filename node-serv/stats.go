@@ -0,0 +1,243 @@
+/*
+	下载任务统计: 进度，速度，peer，worker，上传
+*/
+
+package nodeserv
+
+import (
+	"sync"
+	"time"
+)
+
+// 计算当前速度使用的时间窗口，单位秒
+const STATS_WINDOW = 10
+
+// 按秒统计最近一段时间的数据量，计算当前速度
+type RateMeter struct {
+	lock    sync.Mutex
+	buckets [STATS_WINDOW]int64 // 每秒的数据量
+	seconds [STATS_WINDOW]int64 // 每个桶对应的时间，单位秒
+}
+
+func (rm *RateMeter) Add(n int64) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	now := time.Now().Unix()
+	i := now % STATS_WINDOW
+	if rm.seconds[i] != now {
+		rm.seconds[i] = now
+		rm.buckets[i] = 0
+	}
+	rm.buckets[i] += n
+}
+
+/*
+ * 最近 STATS_WINDOW 秒的平均速度，单位：字节/秒
+ */
+func (rm *RateMeter) Rate() int64 {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	now := time.Now().Unix()
+	total := int64(0)
+	for i := range rm.buckets {
+		if now-rm.seconds[i] < STATS_WINDOW {
+			total += rm.buckets[i]
+		}
+	}
+	return total / STATS_WINDOW
+}
+
+/*
+ * worker 统计，单位：字节，毫秒
+ */
+func (w *Worker) GetStats() map[string]interface{} {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	speed := int64(0)
+	if w.totalDownloadCost > 0 {
+		speed = w.totalDownload * 1000 / w.totalDownloadCost
+	}
+	index := -1
+	if w.cancel != nil {
+		index = w.index
+	}
+	return map[string]interface{}{
+		"id":                  w.id,
+		"block":               index,
+		"total_download":      w.totalDownload,
+		"total_download_cost": w.totalDownloadCost,
+		"speed":               speed,
+		"errors":              w.errorCount,
+		"last_begin_time":     w.lastDownloadBeginTime.Unix(),
+	}
+}
+
+/*
+ * peer 统计
+ */
+func (ps *Peers) Stats() []map[string]interface{} {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	now := time.Now()
+	peers := []map[string]interface{}{}
+	for _, peer := range ps.peers {
+		have := 0
+		for _, v := range peer.blocks {
+			if v == PB_HAVE {
+				have++
+			}
+		}
+		peers = append(peers, map[string]interface{}{
+			"peer_id":        peer.peerId,
+			"addr":           peer.addr,
+			"rate":           int64(peer.rate),
+			"err_rate":       peer.errRate,
+			"active":         peer.active,
+			"total_download": peer.totalDownload,
+			"banned":         now.Before(peer.bannedUntil),
+			"choked":         now.Before(peer.chokedUntil),
+			"have":           have,
+			"syncing":        peer.syncing,
+			"tracker":        peer.fromTracker,
+			"wire":           peer.wireAddr,
+		})
+	}
+	return peers
+}
+
+/*
+ * 记录上传的数据量
+ */
+func (ftMgr *FileTasksMgr) AddUpload(n int64) {
+	ftMgr.lock.Lock()
+	ftMgr.totalUpload += n
+	ftMgr.lock.Unlock()
+
+	ftMgr.uploadMeter.Add(n)
+}
+
+/*
+ * 下载使用的时间，单位秒，调用方加锁
+ */
+func (ftMgr *FileTasksMgr) downloadTime() int64 {
+	cost := ftMgr.totalDownloadCost
+	if ftMgr.stat == FM_DOWNLOAD || ftMgr.diskFull {
+		cost += int64(time.Since(ftMgr.lastDownloadBeginTime).Seconds())
+	}
+	return cost
+}
+
+/*
+ * 任务统计，单位：字节，字节/秒，秒
+ * eta: 预计剩余下载时间，-1: 无法估计
+ */
+func (ftMgr *FileTasksMgr) GetTaskStats() map[string]interface{} {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	// 1. 下载进度，只计算选择下载的文件需要的块
+	completedBlocks := 0
+	completedBytes := int64(0)
+	selectedBytes := int64(0)
+	selectedCompleted := int64(0)
+	for i, block := range ftMgr.fileMeta.blocks {
+		length := int64(ftMgr.blockJob(i).length)
+		if block.blockStat == BS_COMPLETE {
+			completedBlocks++
+			completedBytes += length
+		}
+		if block.priority != FP_SKIP {
+			selectedBytes += length
+			if block.blockStat == BS_COMPLETE {
+				selectedCompleted += length
+			}
+		}
+	}
+	progress := float64(0)
+	if selectedBytes > 0 {
+		progress = float64(selectedCompleted) * 100 / float64(selectedBytes)
+	}
+
+	// 2. 下载速度和剩余时间
+	speed := ftMgr.downloadMeter.Rate()
+	downloadTime := ftMgr.downloadTime()
+	avgSpeed := int64(0)
+	if downloadTime > 0 {
+		avgSpeed = ftMgr.totalDownload / downloadTime
+	}
+	eta := int64(-1)
+	remaining := selectedBytes - selectedCompleted
+	if remaining <= 0 {
+		eta = 0
+	} else if speed > 0 {
+		eta = remaining / speed
+	} else if avgSpeed > 0 {
+		eta = remaining / avgSpeed
+	}
+
+	// 3. peer 和 worker
+	peerList := []map[string]interface{}{}
+	if ftMgr.peers != nil {
+		peerList = ftMgr.peers.Stats()
+	}
+	workers := []map[string]interface{}{}
+	for _, w := range ftMgr.downloadWkrs {
+		workers = append(workers, w.GetStats())
+	}
+
+	memUsed := int64(0)
+	if ftMgr.mem != nil {
+		memUsed, _, _ = ftMgr.mem.Usage()
+	}
+	uploads := map[string]interface{}{}
+	if ftMgr.choker != nil {
+		uploads = ftMgr.choker.Stats()
+	}
+	wireConns := 0
+	if ftMgr.wire != nil {
+		wireConns = ftMgr.wire.Count()
+	}
+	completeTime := int64(0)
+	if !ftMgr.downloadCompleteTime.IsZero() {
+		completeTime = ftMgr.downloadCompleteTime.Unix()
+	}
+
+	return map[string]interface{}{
+		"infohash":           ftMgr.fileMeta.fileMd5,
+		"filename":           ftMgr.fileMeta.filename,
+		"content_type":       ftMgr.fileMeta.contenttype,
+		"stat":               ftMgr.stat,
+		"queued":             ftMgr.queued,
+		"start_err":          ftMgr.startErr,
+		"start_fails":        ftMgr.startFails,
+		"priority":           ftMgr.fileMeta.priority,
+		"sequential":         ftMgr.sequential,
+		"streams":            len(ftMgr.streams),
+		"disk_full":          ftMgr.diskFull,
+		"download_paused":    ftMgr.downloadPaused,
+		"file_size":          ftMgr.fileMeta.fileSize,
+		"block_count":        ftMgr.fileMeta.blockCount,
+		"completed_blocks":   completedBlocks,
+		"completed_bytes":    completedBytes,
+		"selected_bytes":     selectedBytes,
+		"progress":           progress,
+		"download_speed":     speed,
+		"avg_download_speed": avgSpeed,
+		"eta":                eta,
+		"download_time":      downloadTime,
+		"complete_time":      completeTime,
+		"total_download":     ftMgr.totalDownload,
+		"total_upload":       ftMgr.totalUpload,
+		"upload_speed":       ftMgr.uploadMeter.Rate(),
+		"uploads":            uploads,
+		"wire_conns":         wireConns,
+		"peers":              len(peerList),
+		"peer_list":          peerList,
+		"workers":            workers,
+		"mem_used":           memUsed,
+	}
+}
@@ -0,0 +1,88 @@
+/*
+	边下载边读取文件，等待读取的块下载完成
+*/
+
+package nodeserv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// 等待块下载完成的超时时间
+const STREAM_WAIT_TIMEOUT = 60 * time.Second
+
+// 单次读取的最大长度，避免一次等待过多的块
+const STREAM_READ_SIZE = 256 << 10
+
+// 读取下载中的文件，实现 io.ReadSeeker，提供给 http.ServeContent 使用
+type streamReader struct {
+	ctx    context.Context
+	ftMgr  *FileTasksMgr
+	stream int   // 播放请求编号，见 FileTasksMgr.BeginStream
+	size   int64 // 文件大小
+	pos    int64 // 当前读取位置
+}
+
+func newStreamReader(ctx context.Context, ftMgr *FileTasksMgr, stream int) *streamReader {
+	return &streamReader{ctx: ctx,
+		ftMgr:  ftMgr,
+		stream: stream,
+		size:   int64(ftMgr.GetFileSize())}
+}
+
+func (reader *streamReader) Read(p []byte) (int, error) {
+	if reader.pos >= reader.size {
+		return 0, io.EOF
+	}
+	if len(p) > STREAM_READ_SIZE {
+		p = p[:STREAM_READ_SIZE]
+	}
+	if int64(len(p)) > reader.size-reader.pos {
+		p = p[:reader.size-reader.pos]
+	}
+
+	// 等待读取区间的块下载完成，不返回未下载的数据
+	ctx, cancel := context.WithTimeout(reader.ctx, STREAM_WAIT_TIMEOUT)
+	defer cancel()
+	reader.ftMgr.SetReadCursor(reader.stream, int(reader.pos))
+	if err := reader.ftMgr.WaitRange(ctx, reader.stream, int(reader.pos), len(p)); err != nil {
+		return 0, err
+	}
+
+	if err := reader.ftMgr.readAt(p, reader.pos); err != nil {
+		return 0, err
+	}
+	reader.pos += int64(len(p))
+	return len(p), nil
+}
+
+/*
+ * 读取文件区间，在锁内获取文件片段，Start 重新加载元数据时不影响正在进行的读取
+ */
+func (ftMgr *FileTasksMgr) readAt(data []byte, pos int64) error {
+	ftMgr.lock.RLock()
+	spans := ftMgr.fileMeta.spans(pos, len(data))
+	ftMgr.lock.RUnlock()
+
+	return readSpans(spans, data)
+}
+
+func (reader *streamReader) Seek(offset int64, whence int) (int64, error) {
+	pos := reader.pos
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos += offset
+	case io.SeekEnd:
+		pos = reader.size + offset
+	}
+	if pos < 0 {
+		return 0, errors.New("seek position is negative")
+	}
+	reader.pos = pos
+	return pos, nil
+}
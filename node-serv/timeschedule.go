@@ -0,0 +1,229 @@
+/*
+	按时间段控制传输，每周的时间段设置限速，或者暂停下载和上传
+
+	时间表文件格式，按顺序匹配，使用第一个匹配的时间段，没有匹配时使用节点的配置:
+	{"rules": [
+		{"days": [1, 2, 3, 4, 5], "begin": "09:00", "end": "18:00", "download": 128, "upload": 64},
+		{"days": [1, 2, 3, 4, 5], "begin": "12:00", "end": "13:00", "pause_download": true, "pause_upload": true}
+	]}
+	days: 0: 星期日，1 - 6: 星期一到星期六，没有时为每天
+	begin, end: HH:MM，end 小于 begin 时跨过午夜
+	download, upload: 限速，单位：KB/s，0: 不限速，没有时使用节点的配置
+*/
+
+package nodeserv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/blueskyz/uvdt/logger"
+	"github.com/blueskyz/uvdt/node-serv/setting"
+)
+
+// 检查时间表的间隔，单位秒
+const TIME_SCHEDULE_INTERVAL = 30
+
+/*
+ * 当前使用的时间段
+ */
+const (
+	TIME_RULE_NONE  = -1 // 没有匹配的时间段，使用节点的配置
+	TIME_RULE_UNSET = -2 // 还没有应用时间表，第一次检查时一定会应用
+)
+
+// 时间段
+type TimeRule struct {
+	days          [7]bool // 生效的星期
+	begin         int     // 开始时间，单位：分钟
+	end           int     // 结束时间，单位：分钟
+	downloadRate  int     // 下载限速，单位：KB/s，-1: 使用节点的配置
+	uploadRate    int     // 上传限速，单位：KB/s，-1: 使用节点的配置
+	pauseDownload bool    // 暂停下载
+	pauseUpload   bool    // 暂停上传
+}
+
+/*
+ * 解析时间 HH:MM，返回分钟数
+ */
+func parseClock(value string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hour, &minute); err != nil {
+		return 0, errors.New(fmt.Sprintf("time format err, %s", value))
+	}
+	if hour < 0 || minute < 0 || minute >= 60 || hour*60+minute > 24*60 {
+		return 0, errors.New(fmt.Sprintf("time format err, %s", value))
+	}
+	return hour*60 + minute, nil
+}
+
+/*
+ * 加载时间表文件
+ */
+func loadTimeSchedule(file string) ([]TimeRule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	content := make(map[string]interface{})
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	items, ok := content["rules"].([]interface{})
+	if !ok {
+		return nil, errors.New("schedule without rules")
+	}
+
+	rules := []TimeRule{}
+	for i, v := range items {
+		item, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("rule %d format err", i))
+		}
+		rule := TimeRule{downloadRate: -1, uploadRate: -1}
+
+		// 1. 星期
+		if days, ok := item["days"].([]interface{}); ok {
+			for _, day := range days {
+				d, ok := day.(float64)
+				if !ok || d < 0 || d > 6 {
+					return nil, errors.New(fmt.Sprintf("rule %d days err", i))
+				}
+				rule.days[int(d)] = true
+			}
+		} else {
+			for d := range rule.days {
+				rule.days[d] = true
+			}
+		}
+
+		// 2. 时间段
+		begin, _ := item["begin"].(string)
+		end, _ := item["end"].(string)
+		if rule.begin, err = parseClock(begin); err != nil {
+			return nil, errors.New(fmt.Sprintf("rule %d begin err, %s", i, err.Error()))
+		}
+		if rule.end, err = parseClock(end); err != nil {
+			return nil, errors.New(fmt.Sprintf("rule %d end err, %s", i, err.Error()))
+		}
+
+		// 3. 限速和暂停
+		if rate, ok := item["download"].(float64); ok && rate >= 0 {
+			rule.downloadRate = int(rate)
+		}
+		if rate, ok := item["upload"].(float64); ok && rate >= 0 {
+			rule.uploadRate = int(rate)
+		}
+		rule.pauseDownload, _ = item["pause_download"].(bool)
+		rule.pauseUpload, _ = item["pause_upload"].(bool)
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+/*
+ * 时间段是否包含指定时间
+ */
+func (rule *TimeRule) match(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	weekday := int(now.Weekday())
+	if rule.begin <= rule.end {
+		return rule.days[weekday] && minute >= rule.begin && minute < rule.end
+	}
+
+	// 跨过午夜的时间段，午夜之后的部分属于前一天的时间段
+	if minute >= rule.begin {
+		return rule.days[weekday]
+	}
+	return minute < rule.end && rule.days[(weekday+6)%7]
+}
+
+/*
+ * 应用当前时间的时间段，时间段变化时才设置限速，保留通过 api 设置的限速
+ * 1. 设置节点限速
+ * 2. 暂停下载时，取消任务下载中的请求，任务保持原状态并继续上传；恢复后继续下载，并重新调度排队的任务
+ * 3. 暂停上传时，拒绝 peer 的数据块请求
+ */
+func (filesMgr *FilesManager) applyTimeSchedule(now time.Time) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	// 解锁后开始调度选择的任务
+	var starts []*FileTasksMgr
+	defer func() { filesMgr.startTasks(starts) }()
+	filesMgr.lock.Lock()
+	defer filesMgr.lock.Unlock()
+
+	ruleIndex := TIME_RULE_NONE
+	for i := range filesMgr.timeRules {
+		if filesMgr.timeRules[i].match(now) {
+			ruleIndex = i
+			break
+		}
+	}
+	if ruleIndex == filesMgr.timeRuleIndex {
+		return
+	}
+	filesMgr.timeRuleIndex = ruleIndex
+
+	rule := TimeRule{downloadRate: -1, uploadRate: -1}
+	if ruleIndex >= 0 {
+		rule = filesMgr.timeRules[ruleIndex]
+	}
+	downloadRate := setting.AppSetting.GetDownloadRate()
+	if rule.downloadRate >= 0 {
+		downloadRate = rule.downloadRate
+	}
+	uploadRate := setting.AppSetting.GetUploadRate()
+	if rule.uploadRate >= 0 {
+		uploadRate = rule.uploadRate
+	}
+	downloadLimiter.SetRate(int64(downloadRate) << 10)
+	uploadLimiter.SetRate(int64(uploadRate) << 10)
+	log.Info(fmt.Sprintf("Apply time schedule rule: %d, download: %d KB/s, upload: %d KB/s, pause download: %v, pause upload: %v",
+		ruleIndex,
+		downloadRate,
+		uploadRate,
+		rule.pauseDownload,
+		rule.pauseUpload))
+
+	filesMgr.uploadPaused = rule.pauseUpload
+	if rule.pauseDownload == filesMgr.downloadPaused {
+		return
+	}
+	filesMgr.downloadPaused = rule.pauseDownload
+	for _, v := range filesMgr.fileTasksMgr {
+		if filesMgr.downloadPaused {
+			v.PauseDownload()
+		} else {
+			v.ResumeDownload()
+		}
+	}
+	if !filesMgr.downloadPaused {
+		starts = filesMgr.schedule()
+	}
+}
+
+/*
+ * 定时检查时间表
+ */
+func (filesMgr *FilesManager) timeScheduleLoop() {
+	for {
+		time.Sleep(TIME_SCHEDULE_INTERVAL * time.Second)
+		filesMgr.applyTimeSchedule(time.Now())
+	}
+}
+
+/*
+ * 是否暂停上传
+ */
+func (filesMgr *FilesManager) IsUploadPaused() bool {
+	filesMgr.lock.RLock()
+	defer filesMgr.lock.RUnlock()
+
+	return filesMgr.uploadPaused
+}
@@ -0,0 +1,67 @@
+package nodeserv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	cases := []struct {
+		value  string
+		minute int
+		ok     bool
+	}{
+		{"00:00", 0, true},
+		{"08:30", 510, true},
+		{"24:00", 1440, true},
+		{"24:01", 0, false},
+		{"12:60", 0, false},
+		{"-1:00", 0, false},
+		{"noon", 0, false},
+	}
+	for _, c := range cases {
+		minute, err := parseClock(c.value)
+		if (err == nil) != c.ok || (c.ok && minute != c.minute) {
+			t.Errorf("parseClock(%s) = %d, %v, want %d, ok: %v", c.value, minute, err, c.minute, c.ok)
+		}
+	}
+}
+
+func TestTimeRuleMatch(t *testing.T) {
+	// 2024-01-01 是星期一
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	weekdays := [7]bool{false, true, true, true, true, true, false}
+	sunday := [7]bool{true, false, false, false, false, false, false}
+	day := TimeRule{days: weekdays, begin: 9 * 60, end: 18 * 60}
+	night := TimeRule{days: weekdays, begin: 23 * 60, end: 7 * 60}
+	sundayNight := TimeRule{days: sunday, begin: 22 * 60, end: 2 * 60}
+
+	cases := []struct {
+		rule TimeRule
+		now  time.Time
+		want bool
+	}{
+		{day, at(1, 9, 0), true},
+		{day, at(1, 17, 59), true},
+		{day, at(1, 18, 0), false}, // 结束时间不包含在内
+		{day, at(1, 8, 59), false},
+		{day, at(6, 12, 0), false}, // 星期六
+		{night, at(1, 23, 30), true},
+		{night, at(2, 6, 59), true}, // 午夜之后属于星期一的时间段
+		{night, at(2, 7, 0), false},
+		{night, at(1, 6, 0), false}, // 星期一凌晨属于星期日的时间段
+		{night, at(6, 3, 0), true},  // 星期六凌晨属于星期五的时间段
+		{night, at(6, 23, 30), false},
+		{sundayNight, at(7, 23, 0), true},
+		{sundayNight, at(8, 1, 0), true}, // 星期日跨到星期一
+		{sundayNight, at(8, 2, 0), false},
+		{sundayNight, at(7, 1, 0), false}, // 星期日凌晨属于星期六的时间段
+	}
+	for _, c := range cases {
+		if got := c.rule.match(c.now); got != c.want {
+			t.Errorf("%+v match %s = %v, want %v", c.rule, c.now.Format("Mon 15:04"), got, c.want)
+		}
+	}
+}
@@ -3,3 +3,125 @@
 */
 
 package nodeserv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 内存不足，暂时无法提供数据块
+var ErrUploadBusy = errors.New("upload busy")
+
+// 请求的区间超出数据块
+var ErrInvalidRange = errors.New("invalid range")
+
+/*
+ * 解析块内的 http range: bytes=a-b, bytes=a-, bytes=-n，只支持一个区间
+ * 没有 range 时返回整个块，partial 为 false
+ */
+func parseBlockRange(value string, blockLength int) (int, int, bool, error) {
+	if value == "" {
+		return 0, blockLength, false, nil
+	}
+	if !strings.HasPrefix(value, "bytes=") || strings.Contains(value, ",") {
+		return 0, 0, false, ErrInvalidRange
+	}
+	items := strings.SplitN(strings.TrimSpace(value[len("bytes="):]), "-", 2)
+	if len(items) != 2 {
+		return 0, 0, false, ErrInvalidRange
+	}
+
+	var begin, end int
+	var err error
+	if items[0] == "" {
+		// 最后 n 个字节
+		n, err := strconv.Atoi(items[1])
+		if err != nil || n <= 0 {
+			return 0, 0, false, ErrInvalidRange
+		}
+		if n > blockLength {
+			n = blockLength
+		}
+		return blockLength - n, n, true, nil
+	}
+	if begin, err = strconv.Atoi(items[0]); err != nil || begin < 0 || begin >= blockLength {
+		return 0, 0, false, ErrInvalidRange
+	}
+	end = blockLength - 1
+	if items[1] != "" {
+		if end, err = strconv.Atoi(items[1]); err != nil || end < begin {
+			return 0, 0, false, ErrInvalidRange
+		}
+		if end >= blockLength {
+			end = blockLength - 1
+		}
+	}
+	return begin, end - begin + 1, true, nil
+}
+
+/*
+ * 数据块的长度和 md5，块未下载完成或者任务没有开始时返回 ErrBlockNotFound
+ */
+func (ftMgr *FileTasksMgr) GetBlockInfo(index int) (int, string, error) {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	if ftMgr.stat != FM_DOWNLOAD && ftMgr.stat != FM_SHARE {
+		return 0, "", ErrBlockNotFound
+	}
+	if index < 0 || index >= len(ftMgr.fileMeta.blocks) {
+		return 0, "", ErrBlockNotFound
+	}
+	block := ftMgr.fileMeta.blocks[index]
+	if block.blockStat != BS_COMPLETE {
+		return 0, "", ErrBlockNotFound
+	}
+	return int(ftMgr.blockJob(index).length), block.blockMd5, nil
+}
+
+/*
+ * 读取已完成的数据块的区间 [offset, offset+length)
+ * 读取的数据占用任务的内存配额，返回的 release 在发送完成后调用
+ */
+func (ftMgr *FileTasksMgr) ReadBlock(index int, offset int, length int) ([]byte, func(), error) {
+	ftMgr.lock.RLock()
+	if ftMgr.stat != FM_DOWNLOAD && ftMgr.stat != FM_SHARE {
+		ftMgr.lock.RUnlock()
+		return nil, nil, ErrBlockNotFound
+	}
+	if index < 0 || index >= len(ftMgr.fileMeta.blocks) ||
+		ftMgr.fileMeta.blocks[index].blockStat != BS_COMPLETE {
+		ftMgr.lock.RUnlock()
+		return nil, nil, ErrBlockNotFound
+	}
+	jobData := ftMgr.blockJob(index)
+	mem := ftMgr.mem
+	ftMgr.lock.RUnlock()
+
+	if offset < 0 || length <= 0 || offset+length > int(jobData.length) {
+		return nil, nil, ErrInvalidRange
+	}
+	if !mem.TryAcquire(int64(length)) {
+		return nil, nil, ErrUploadBusy
+	}
+	release := func() { mem.Release(int64(length)) }
+
+	data := make([]byte, length)
+	if err := ftMgr.fileMeta.ReadAt(data, int64(jobData.pos)+int64(offset)); err != nil {
+		release()
+		return nil, nil, errors.New(fmt.Sprintf("read block %d fail, %s", index, err.Error()))
+	}
+	return data, release, nil
+}
+
+/*
+ * 上传限速，任务限速和节点限速
+ */
+func (ftMgr *FileTasksMgr) uploadLimiters() []*RateLimiter {
+	ftMgr.lock.RLock()
+	defer ftMgr.lock.RUnlock()
+
+	return []*RateLimiter{ftMgr.uploadLimiter, uploadLimiter}
+}
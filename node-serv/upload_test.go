@@ -0,0 +1,40 @@
+package nodeserv
+
+import "testing"
+
+func TestParseBlockRange(t *testing.T) {
+	const full = 1024
+	const last = 100 // 最后一个块比其他块短
+	cases := []struct {
+		value       string
+		blockLength int
+		offset      int
+		length      int
+		partial     bool
+		err         error
+	}{
+		{"", full, 0, full, false, nil},
+		{"", last, 0, last, false, nil},
+		{"bytes=0-1023", full, 0, full, true, nil},
+		{"bytes=100-199", full, 100, 100, true, nil},
+		{"bytes=1000-", full, 1000, 24, true, nil},
+		{"bytes=-24", full, 1000, 24, true, nil},
+		{"bytes=50-1023", last, 50, 50, true, nil}, // 结束位置超出短块时截断
+		{"bytes=-200", last, 0, last, true, nil},
+		{"bytes=99-99", last, 99, 1, true, nil},
+		{"bytes=100-", last, 0, 0, false, ErrInvalidRange}, // 起始位置超出短块
+		{"bytes=200-100", full, 0, 0, false, ErrInvalidRange},
+		{"bytes=-0", full, 0, 0, false, ErrInvalidRange},
+		{"bytes=0-1,5-6", full, 0, 0, false, ErrInvalidRange},
+		{"items=0-1", full, 0, 0, false, ErrInvalidRange},
+		{"bytes=a-b", full, 0, 0, false, ErrInvalidRange},
+	}
+	for _, c := range cases {
+		offset, length, partial, err := parseBlockRange(c.value, c.blockLength)
+		if err != c.err || offset != c.offset || length != c.length || partial != c.partial {
+			t.Errorf("parseBlockRange(%q, %d) = %d, %d, %v, %v, want %d, %d, %v, %v",
+				c.value, c.blockLength, offset, length, partial, err,
+				c.offset, c.length, c.partial, c.err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+	web seed，没有 peer 可以提供数据时，从种子中的 http 源服务器下载
+*/
+
+package nodeserv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// web seed 在 peer 列表中的标识，md5 校验失败时不会禁用
+const WEB_SEED_PEER_ID = "webseed"
+
+/*
+ * 从种子或元数据中加载 web seed 地址: "web_seeds": ["http://host/path/"]
+ */
+func (fileMeta *FileMeta) loadWebSeeds(content map[string]interface{}) {
+	fileMeta.webSeeds = nil
+	seeds, ok := content["web_seeds"].([]interface{})
+	if !ok {
+		return
+	}
+	for _, v := range seeds {
+		seed, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(seed, "http://") || strings.HasPrefix(seed, "https://") {
+			fileMeta.webSeeds = append(fileMeta.webSeeds, seed)
+		}
+	}
+}
+
+/*
+ * 数据流中的所有文件在 web seed 上的路径，单文件种子为文件名，多文件种子为 文件名/路径
+ */
+func (fileMeta *FileMeta) webSeedFiles() []FileEntry {
+	if fileMeta.contenttype != CT_MULTIFILE {
+		return []FileEntry{{path: fileMeta.filename, size: int64(fileMeta.fileSize)}}
+	}
+
+	files := []FileEntry{}
+	for _, v := range fileMeta.files {
+		files = append(files, FileEntry{path: fileMeta.filename + "/" + v.path,
+			size:   v.size,
+			offset: v.offset})
+	}
+	return files
+}
+
+// web seed 下载
+type WebSeed struct {
+	lock   sync.Mutex
+	urls   []string    // 源服务器地址
+	files  []FileEntry // 文件在源服务器上的路径
+	single bool        // 单文件种子
+	next   int         // 下一次使用的地址，轮流使用
+}
+
+func NewWebSeed(fileMeta *FileMeta) *WebSeed {
+	if len(fileMeta.webSeeds) == 0 {
+		return nil
+	}
+	return &WebSeed{urls: fileMeta.webSeeds,
+		files:  fileMeta.webSeedFiles(),
+		single: fileMeta.contenttype != CT_MULTIFILE}
+}
+
+/*
+ * 文件的下载地址
+ * 1. 地址以 / 结尾时为目录，添加文件路径
+ * 2. 单文件种子的地址不以 / 结尾时为文件地址
+ */
+func (ws *WebSeed) fileURL(seed string, filePath string) string {
+	if ws.single && !strings.HasSuffix(seed, "/") {
+		return seed
+	}
+	items := strings.Split(filePath, "/")
+	for i, v := range items {
+		items[i] = url.PathEscape(v)
+	}
+	return strings.TrimSuffix(seed, "/") + "/" + strings.Join(items, "/")
+}
+
+/*
+ * 下载数据流的区间 [pos, pos+len(buf))，区间可能跨越多个文件
+ * 依次尝试每个源服务器，所有服务器都失败时返回最后的错误
+ */
+func (ws *WebSeed) Download(ctx context.Context,
+	pos int64,
+	buf []byte,
+	progress transferProgress,
+	limiters ...*RateLimiter) error {
+	ws.lock.Lock()
+	first := ws.next
+	ws.next = (ws.next + 1) % len(ws.urls)
+	ws.lock.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(ws.urls); i++ {
+		seed := ws.urls[(first+i)%len(ws.urls)]
+		lastErr = ws.downloadFrom(ctx, seed, pos, buf, progress, limiters...)
+		if lastErr == nil || ctx.Err() != nil {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+func (ws *WebSeed) downloadFrom(ctx context.Context,
+	seed string,
+	pos int64,
+	buf []byte,
+	progress transferProgress,
+	limiters ...*RateLimiter) error {
+
+	spans := mapSpans(ws.files, pos, len(buf))
+	if len(spans) == 0 {
+		return errors.New(fmt.Sprintf("web seed range err, pos: %d, length: %d", pos, len(buf)))
+	}
+	for _, v := range spans {
+		fileURL := ws.fileURL(seed, v.file)
+		data, err := downloadRange(ctx, fileURL, uint(v.offset), uint(v.length), progress, limiters...)
+		if err != nil {
+			return errors.New(fmt.Sprintf("download from %s fail, %s", fileURL, err.Error()))
+		}
+		copy(buf[v.start:v.start+v.length], data)
+	}
+	return nil
+}
@@ -0,0 +1,546 @@
+/*
+	peer 之间的 tcp 长连接协议，一个连接上传输多个数据块请求，减少 http 请求的往返和建立连接的开销
+
+	消息格式: [4 字节长度][1 字节类型][内容]，长度包括类型，大端序，长度为 0 的消息为 keep-alive
+	handshake: [1 字节长度][协议名][1 字节长度][infohash][1 字节长度][peer_id]
+	bitfield:  已完成块的位图，与 http bitfield 相同
+	have:      [4 字节块序号]
+	request:   [4 字节块序号][4 字节块内偏移][4 字节长度]
+	piece:     [4 字节块序号][4 字节块内偏移][数据]
+	cancel:    [4 字节块序号][4 字节块内偏移][4 字节长度]
+	reject:    [4 字节块序号][4 字节块内偏移][4 字节长度][1 字节原因][4 字节重试等待秒数]
+
+	1. 请求方连接后发送 handshake，被请求方返回 handshake，随后发送 bitfield，块完成时发送 have
+	2. 请求方发送 request，被请求方返回 piece 或 reject，cancel 取消还没有处理的请求
+	3. 空闲时双方定时发送 keep-alive
+*/
+
+package nodeserv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blueskyz/uvdt/logger"
+	"github.com/blueskyz/uvdt/node-serv/setting"
+)
+
+// 协议名
+const WIRE_PROTOCOL = "uvdt/1"
+
+/*
+ * worker 下载使用的传输方式
+ */
+const (
+	TRANSPORT_HTTP = "http" // 每个子块一个 http 请求
+	TRANSPORT_WIRE = "wire" // tcp 长连接，peer 不支持时使用 http
+)
+
+/*
+ * 消息类型
+ */
+const (
+	MSG_KEEPALIVE = -1 // 长度为 0 的消息，没有类型
+	MSG_HANDSHAKE = 0
+	MSG_BITFIELD  = 1
+	MSG_HAVE      = 2
+	MSG_REQUEST   = 3
+	MSG_PIECE     = 4
+	MSG_CANCEL    = 5
+	MSG_REJECT    = 6
+)
+
+/*
+ * 拒绝请求的原因
+ */
+const (
+	REJECT_NOT_FOUND = 1 // 块没有下载完成，或者区间错误
+	REJECT_BUSY      = 2 // 暂停上传，上传位置已满，或者内存不足
+)
+
+const (
+	WIRE_MAX_REQUEST        = 1 << 20              // 单个请求的最大长度
+	WIRE_MAX_MESSAGE        = WIRE_MAX_REQUEST + 9 // 最大消息长度，piece 消息
+	WIRE_MAX_PENDING        = 16                   // 每个连接等待处理的请求数量
+	WIRE_HANDSHAKE_TIMEOUT  = 10                   // 握手超时，单位秒
+	WIRE_KEEPALIVE_INTERVAL = 30                   // 空闲时发送 keep-alive 的间隔，单位秒
+	WIRE_IDLE_TIMEOUT       = 120                  // 没有收到任何消息时断开连接，单位秒
+)
+
+// 连接 peer 失败，或者 peer 不支持 wire 协议
+var ErrWireUnavailable = errors.New("wire unavailable")
+
+// 消息
+type wireMsg struct {
+	id      int
+	payload []byte
+}
+
+// 块区间，request，piece，cancel，reject 使用
+type wireRequest struct {
+	index  uint32
+	offset uint32
+	length uint32
+}
+
+/*
+ * 按块序号和块内偏移匹配请求和返回的 piece，长度不一致时为错误的数据
+ */
+func (req wireRequest) key() uint64 {
+	return uint64(req.index)<<32 | uint64(req.offset)
+}
+
+func (req wireRequest) encode() []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf[0:], req.index)
+	binary.BigEndian.PutUint32(buf[4:], req.offset)
+	binary.BigEndian.PutUint32(buf[8:], req.length)
+	return buf
+}
+
+func decodeRequest(payload []byte) (wireRequest, error) {
+	if len(payload) < 12 {
+		return wireRequest{}, errors.New("request length err")
+	}
+	return wireRequest{index: binary.BigEndian.Uint32(payload[0:]),
+		offset: binary.BigEndian.Uint32(payload[4:]),
+		length: binary.BigEndian.Uint32(payload[8:])}, nil
+}
+
+func encodeHandshake(infoHash string, peerId string) []byte {
+	buf := []byte{}
+	for _, v := range []string{WIRE_PROTOCOL, infoHash, peerId} {
+		buf = append(buf, byte(len(v)))
+		buf = append(buf, v...)
+	}
+	return buf
+}
+
+/*
+ * 解析 handshake，返回 infohash 和 peer_id
+ */
+func decodeHandshake(payload []byte) (string, string, error) {
+	items := []string{}
+	for i := 0; i < 3; i++ {
+		if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+			return "", "", errors.New("handshake length err")
+		}
+		items = append(items, string(payload[1:1+int(payload[0])]))
+		payload = payload[1+int(payload[0]):]
+	}
+	if items[0] != WIRE_PROTOCOL {
+		return "", "", errors.New(fmt.Sprintf("protocol err, %s", items[0]))
+	}
+	if items[1] == "" || items[2] == "" {
+		return "", "", errors.New("handshake infohash or peer_id is empty")
+	}
+	return items[1], items[2], nil
+}
+
+func readMsg(r io.Reader) (wireMsg, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return wireMsg{}, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 {
+		return wireMsg{id: MSG_KEEPALIVE}, nil
+	}
+	if length > WIRE_MAX_MESSAGE {
+		return wireMsg{}, errors.New(fmt.Sprintf("message too long, %d", length))
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return wireMsg{}, err
+	}
+	return wireMsg{id: int(buf[0]), payload: buf[1:]}, nil
+}
+
+// 连接，写入加锁，读取由一个协程负责
+type wireConn struct {
+	conn  net.Conn
+	wlock sync.Mutex
+}
+
+/*
+ * 发送消息，id 为 MSG_KEEPALIVE 时发送 keep-alive
+ */
+func (wc *wireConn) send(id int, payload ...[]byte) error {
+	length := 0
+	for _, v := range payload {
+		length += len(v)
+	}
+	header := make([]byte, 5)
+	if id == MSG_KEEPALIVE {
+		header = header[:4]
+	} else {
+		binary.BigEndian.PutUint32(header, uint32(length+1))
+		header[4] = byte(id)
+	}
+
+	wc.wlock.Lock()
+	defer wc.wlock.Unlock()
+
+	wc.conn.SetWriteDeadline(time.Now().Add(PEER_RESPONSE_TIMEOUT * time.Second))
+	if _, err := wc.conn.Write(header); err != nil {
+		return err
+	}
+	for _, v := range payload {
+		if _, err := wc.conn.Write(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wc *wireConn) reject(req wireRequest, reason int, retryAfter int) error {
+	buf := make([]byte, 5)
+	buf[0] = byte(reason)
+	binary.BigEndian.PutUint32(buf[1:], uint32(retryAfter))
+	return wc.send(MSG_REJECT, req.encode(), buf)
+}
+
+// ==========================================================================
+// 下载方
+
+// 请求的结果
+type wireResult struct {
+	data []byte
+	err  error
+}
+
+// 等待返回的请求
+type wirePending struct {
+	req wireRequest
+	ch  chan wireResult
+}
+
+// 到一个 peer 的连接
+type wirePeerConn struct {
+	wireConn
+	pool    *WirePool
+	peerId  string
+	lock    sync.Mutex
+	pending map[uint64]wirePending // 等待返回的请求，wireRequest.key() -> 请求
+	done    chan bool              // 连接关闭时关闭
+	err     error
+}
+
+// 任务的 wire 连接池，每个 peer 一个连接
+type WirePool struct {
+	lock       sync.Mutex
+	infoHash   string
+	blockCount int
+	peers      *Peers
+	conns      map[string]*wirePeerConn // peer_id -> 连接
+	closed     bool
+}
+
+func NewWirePool(infoHash string, blockCount int, peers *Peers) *WirePool {
+	return &WirePool{infoHash: infoHash,
+		blockCount: blockCount,
+		peers:      peers,
+		conns:      make(map[string]*wirePeerConn)}
+}
+
+/*
+ * 获取到 peer 的连接，没有时建立连接并握手
+ */
+func (wp *WirePool) get(ctx context.Context, peerId string, addr string) (*wirePeerConn, error) {
+	wp.lock.Lock()
+	if wp.closed {
+		wp.lock.Unlock()
+		return nil, errors.New("wire pool closed")
+	}
+	if pc, ok := wp.conns[peerId]; ok {
+		wp.lock.Unlock()
+		return pc, nil
+	}
+	wp.lock.Unlock()
+
+	pc, err := wp.dial(ctx, peerId, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 同时建立了多个连接时使用先建立的连接
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	if exist, ok := wp.conns[peerId]; ok || wp.closed {
+		// 连接还没有加入连接池，直接关闭，不能调用 pc.close
+		pc.conn.Close()
+		if wp.closed {
+			return nil, errors.New("wire pool closed")
+		}
+		return exist, nil
+	}
+	wp.conns[peerId] = pc
+	go pc.readLoop()
+	go pc.keepAliveLoop()
+	return pc, nil
+}
+
+func (wp *WirePool) dial(ctx context.Context, peerId string, addr string) (*wirePeerConn, error) {
+	dialer := net.Dialer{Timeout: PEER_DIAL_TIMEOUT * time.Second, KeepAlive: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc := &wirePeerConn{wireConn: wireConn{conn: conn},
+		pool:    wp,
+		peerId:  peerId,
+		pending: make(map[uint64]wirePending),
+		done:    make(chan bool)}
+
+	// 握手，peer_id 必须与 tracker 返回的一致
+	if err := pc.send(MSG_HANDSHAKE, encodeHandshake(wp.infoHash, setting.AppSetting.GetPeerId())); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(WIRE_HANDSHAKE_TIMEOUT * time.Second))
+	msg, err := readMsg(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if msg.id != MSG_HANDSHAKE {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("handshake message err, %d", msg.id))
+	}
+	infoHash, remotePeerId, err := decodeHandshake(msg.payload)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if infoHash != wp.infoHash || remotePeerId != peerId {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("handshake err, infohash: %s, peer_id: %s", infoHash, remotePeerId))
+	}
+	return pc, nil
+}
+
+/*
+ * 连接关闭，从连接池中删除
+ */
+func (wp *WirePool) remove(peerId string, pc *wirePeerConn) {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	if wp.conns[peerId] == pc {
+		delete(wp.conns, peerId)
+	}
+}
+
+/*
+ * 关闭所有连接
+ */
+func (wp *WirePool) Close() {
+	wp.lock.Lock()
+	wp.closed = true
+	conns := wp.conns
+	wp.conns = make(map[string]*wirePeerConn)
+	wp.lock.Unlock()
+
+	for _, pc := range conns {
+		pc.close(errors.New("wire pool closed"))
+	}
+}
+
+func (wp *WirePool) Count() int {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	return len(wp.conns)
+}
+
+/*
+ * 通过 wire 连接下载数据块的区间，ctx 取消时发送 cancel
+ * 建立连接失败时返回 ErrWireUnavailable，由调用方使用 http 下载
+ * 数据整个接收后按 limiters 限速，收到数据和等待限速时更新 progress
+ */
+func (wp *WirePool) Download(ctx context.Context,
+	peerId string,
+	addr string,
+	index int,
+	offset uint,
+	length uint,
+	progress transferProgress,
+	limiters ...*RateLimiter) ([]byte, error) {
+
+	if length == 0 || length > WIRE_MAX_REQUEST {
+		return nil, errors.New(fmt.Sprintf("request length err, %d", length))
+	}
+	pc, err := wp.get(ctx, peerId, addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log := logger.NewAgent()
+		log.Err(fmt.Sprintf("Connect to %s[%s] fail, %s", peerId, addr, err.Error()))
+		log.EndLog()
+		return nil, ErrWireUnavailable
+	}
+
+	data, err := pc.request(ctx, wireRequest{index: uint32(index),
+		offset: uint32(offset),
+		length: uint32(length)})
+	if err != nil {
+		return nil, err
+	}
+	if progress != nil {
+		progress.touch()
+	}
+	if err := waitLimiters(ctx, len(data), progress, limiters); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (pc *wirePeerConn) request(ctx context.Context, req wireRequest) ([]byte, error) {
+	ch := make(chan wireResult, 1)
+	pc.lock.Lock()
+	if pc.err != nil {
+		pc.lock.Unlock()
+		return nil, pc.err
+	}
+	if _, ok := pc.pending[req.key()]; ok {
+		pc.lock.Unlock()
+		return nil, errors.New("duplicate request")
+	}
+	pc.pending[req.key()] = wirePending{req: req, ch: ch}
+	pc.lock.Unlock()
+
+	if err := pc.send(MSG_REQUEST, req.encode()); err != nil {
+		pc.close(err)
+		return nil, err
+	}
+
+	select {
+	case result := <-ch:
+		return result.data, result.err
+	case <-ctx.Done():
+		if _, ok := pc.take(req.index, req.offset); ok {
+			pc.send(MSG_CANCEL, req.encode())
+		}
+		return nil, ctx.Err()
+	}
+}
+
+/*
+ * 取出等待返回的请求，请求已经取消时 ok 为 false
+ */
+func (pc *wirePeerConn) take(index uint32, offset uint32) (wirePending, bool) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	key := wireRequest{index: index, offset: offset}.key()
+	pending, ok := pc.pending[key]
+	delete(pc.pending, key)
+	return pending, ok
+}
+
+/*
+ * 关闭连接，所有等待的请求返回错误
+ */
+func (pc *wirePeerConn) close(err error) {
+	pc.lock.Lock()
+	if pc.err != nil {
+		pc.lock.Unlock()
+		return
+	}
+	pc.err = err
+	pending := pc.pending
+	pc.pending = make(map[uint64]wirePending)
+	close(pc.done)
+	pc.lock.Unlock()
+
+	pc.conn.Close()
+	pc.pool.remove(pc.peerId, pc)
+	for _, v := range pending {
+		v.ch <- wireResult{err: err}
+	}
+}
+
+/*
+ * 接收 peer 的消息
+ */
+func (pc *wirePeerConn) readLoop() {
+	for {
+		pc.conn.SetReadDeadline(time.Now().Add(WIRE_IDLE_TIMEOUT * time.Second))
+		msg, err := readMsg(pc.conn)
+		if err != nil {
+			pc.close(err)
+			return
+		}
+
+		switch msg.id {
+		case MSG_BITFIELD:
+			if have, err := decodeBitfield(msg.payload, pc.pool.blockCount); err == nil {
+				pc.pool.peers.SetBitfield(pc.peerId, have)
+			}
+		case MSG_HAVE:
+			if len(msg.payload) >= 4 {
+				pc.pool.peers.SetBlock(pc.peerId, int(binary.BigEndian.Uint32(msg.payload)), PB_HAVE)
+			}
+		case MSG_PIECE:
+			if len(msg.payload) < 8 {
+				pc.close(errors.New("piece length err"))
+				return
+			}
+			data := msg.payload[8:]
+			pending, ok := pc.take(binary.BigEndian.Uint32(msg.payload[0:]), binary.BigEndian.Uint32(msg.payload[4:]))
+			if !ok {
+				// 请求已经取消
+				continue
+			}
+			if uint32(len(data)) != pending.req.length {
+				err := errors.New(fmt.Sprintf("piece length err, expect: %d, got: %d",
+					pending.req.length,
+					len(data)))
+				pending.ch <- wireResult{err: err}
+				pc.close(err)
+				return
+			}
+			pending.ch <- wireResult{data: data}
+		case MSG_REJECT:
+			req, err := decodeRequest(msg.payload)
+			if err != nil || len(msg.payload) < 17 {
+				pc.close(errors.New("reject length err"))
+				return
+			}
+			pending, ok := pc.take(req.index, req.offset)
+			if !ok {
+				continue
+			}
+			if msg.payload[12] == REJECT_BUSY {
+				retryAfter := time.Duration(binary.BigEndian.Uint32(msg.payload[13:])) * time.Second
+				pending.ch <- wireResult{err: &PeerBusyError{retryAfter: retryAfter}}
+			} else {
+				pending.ch <- wireResult{err: ErrBlockNotFound}
+			}
+		}
+	}
+}
+
+/*
+ * 定时发送 keep-alive
+ */
+func (pc *wirePeerConn) keepAliveLoop() {
+	for {
+		select {
+		case <-time.After(WIRE_KEEPALIVE_INTERVAL * time.Second):
+		case <-pc.done:
+			return
+		}
+		if err := pc.send(MSG_KEEPALIVE); err != nil {
+			pc.close(err)
+			return
+		}
+	}
+}
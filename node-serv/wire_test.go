@@ -0,0 +1,173 @@
+package nodeserv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blueskyz/uvdt/node-serv/setting"
+)
+
+func TestHandshake(t *testing.T) {
+	infoHash, peerId, err := decodeHandshake(encodeHandshake("abc", "peer1"))
+	if err != nil || infoHash != "abc" || peerId != "peer1" {
+		t.Fatalf("decode handshake: %s, %s, %v", infoHash, peerId, err)
+	}
+
+	payload := encodeHandshake("abc", "peer1")
+	for i := 0; i < len(payload); i++ {
+		if _, _, err := decodeHandshake(payload[:i]); err == nil {
+			t.Errorf("truncated handshake %d should fail", i)
+		}
+	}
+	if _, _, err := decodeHandshake(encodeHandshake("abc", "")); err == nil {
+		t.Error("empty peer_id should fail")
+	}
+	bad := append([]byte{6}, "uvdt/2"...)
+	bad = append(bad, payload[1+len(WIRE_PROTOCOL):]...)
+	if _, _, err := decodeHandshake(bad); err == nil {
+		t.Error("wrong protocol should fail")
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	req := wireRequest{index: 7, offset: 1 << 16, length: 1 << 20}
+	got, err := decodeRequest(req.encode())
+	if err != nil || got != req {
+		t.Fatalf("decode request: %+v, %v", got, err)
+	}
+	if _, err := decodeRequest(req.encode()[:11]); err == nil {
+		t.Error("short request should fail")
+	}
+}
+
+func TestReadMsg(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	wc := &wireConn{conn: client}
+	go func() {
+		wc.send(MSG_KEEPALIVE)
+		wc.send(MSG_PIECE, []byte{0, 0, 0, 1, 0, 0, 0, 2}, []byte("data"))
+	}()
+
+	msg, err := readMsg(server)
+	if err != nil || msg.id != MSG_KEEPALIVE {
+		t.Fatalf("read keep-alive: %+v, %v", msg, err)
+	}
+	msg, err = readMsg(server)
+	if err != nil || msg.id != MSG_PIECE || !bytes.Equal(msg.payload[8:], []byte("data")) {
+		t.Fatalf("read piece: %+v, %v", msg, err)
+	}
+}
+
+func TestReadMsgBadFrame(t *testing.T) {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, WIRE_MAX_MESSAGE+1)
+	if _, err := readMsg(bytes.NewReader(header)); err == nil {
+		t.Error("oversized frame should fail")
+	}
+
+	binary.BigEndian.PutUint32(header, 10)
+	frame := append(header, MSG_PIECE, 1, 2)
+	if _, err := readMsg(bytes.NewReader(frame)); err != io.ErrUnexpectedEOF {
+		t.Errorf("short frame: %v", err)
+	}
+	if _, err := readMsg(bytes.NewReader(header[:2])); err != io.ErrUnexpectedEOF {
+		t.Errorf("short header: %v", err)
+	}
+}
+
+/*
+ * 模拟上传方，握手后按 handle 返回请求的结果
+ */
+func serveWireTest(t *testing.T, handle func(wc *wireConn, req wireRequest)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := readMsg(conn); err != nil {
+			return
+		}
+		wc := &wireConn{conn: conn}
+		wc.send(MSG_HANDSHAKE, encodeHandshake("abc", "server"))
+		for {
+			msg, err := readMsg(conn)
+			if err != nil {
+				return
+			}
+			if req, err := decodeRequest(msg.payload); err == nil && msg.id == MSG_REQUEST {
+				handle(wc, req)
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func sendPiece(wc *wireConn, req wireRequest, length int) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:], req.index)
+	binary.BigEndian.PutUint32(header[4:], req.offset)
+	wc.send(MSG_PIECE, header, make([]byte, length))
+}
+
+func TestWirePoolDownload(t *testing.T) {
+	setting.AppSetting.SetPeerId("client")
+	addr := serveWireTest(t, func(wc *wireConn, req wireRequest) {
+		switch req.index {
+		case 0:
+			sendPiece(wc, req, int(req.length))
+		case 1:
+			wc.reject(req, REJECT_BUSY, 5)
+		default:
+			wc.reject(req, REJECT_NOT_FOUND, 0)
+		}
+	})
+	wp := NewWirePool("abc", 3, NewPeers(3))
+	defer wp.Close()
+
+	data, err := wp.Download(context.Background(), "server", addr, 0, 16, 100, nil)
+	if err != nil || len(data) != 100 {
+		t.Fatalf("download piece: %d, %v", len(data), err)
+	}
+	_, err = wp.Download(context.Background(), "server", addr, 1, 0, 100, nil)
+	if busy, ok := err.(*PeerBusyError); !ok || busy.retryAfter != 5*time.Second {
+		t.Fatalf("busy reject: %v", err)
+	}
+	if _, err = wp.Download(context.Background(), "server", addr, 2, 0, 100, nil); err != ErrBlockNotFound {
+		t.Fatalf("not found reject: %v", err)
+	}
+	if wp.Count() != 1 {
+		t.Errorf("connections: %d", wp.Count())
+	}
+}
+
+func TestWirePoolPieceLengthMismatch(t *testing.T) {
+	setting.AppSetting.SetPeerId("client")
+	addr := serveWireTest(t, func(wc *wireConn, req wireRequest) {
+		sendPiece(wc, req, int(req.length)-1)
+	})
+	wp := NewWirePool("abc", 1, NewPeers(1))
+	defer wp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := wp.Download(ctx, "server", addr, 0, 0, 100, nil); err == nil || ctx.Err() != nil {
+		t.Fatalf("short piece should fail without waiting: %v", err)
+	}
+	if wp.Count() != 0 {
+		t.Errorf("connection should be closed, connections: %d", wp.Count())
+	}
+}
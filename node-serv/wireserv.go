@@ -0,0 +1,316 @@
+/*
+	bt wire 服务，与 bt http 服务一起提供数据块上传
+*/
+
+package nodeserv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blueskyz/uvdt/logger"
+	"github.com/blueskyz/uvdt/node-serv/setting"
+)
+
+var wireFilesMgr *FilesManager
+
+func WireServ(filesManager *FilesManager) error {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	wireFilesMgr = filesManager
+
+	wireServ := setting.AppSetting.GetWireServ()
+	if wireServ.Port == 0 {
+		log.Info("Wire serv disabled")
+		return nil
+	}
+	log.Info(fmt.Sprintf("%s:%d", wireServ.Ip, wireServ.Port))
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", wireServ.Ip, wireServ.Port))
+	if err != nil {
+		log.Err(err.Error())
+		return err
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Err(err.Error())
+			return err
+		}
+		go serveWireConn(conn)
+	}
+}
+
+// 上传方的一个连接
+type wireSession struct {
+	wireConn
+	ftMgr     *FileTasksMgr
+	infoHash  string
+	peerId    string
+	requests  chan wireRequest // 等待处理的请求
+	lock      sync.Mutex
+	cancelled map[wireRequest]int // 已取消但还在 requests 中的请求
+	ctx       context.Context
+}
+
+/*
+ * 处理一个 wire 连接
+ * 1. 握手，任务不存在时断开
+ * 2. 发送 bitfield 和 have
+ * 3. 接收请求，按顺序返回数据
+ */
+func serveWireConn(conn net.Conn) {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(WIRE_HANDSHAKE_TIMEOUT * time.Second))
+	msg, err := readMsg(conn)
+	if err != nil || msg.id != MSG_HANDSHAKE {
+		log.Err(fmt.Sprintf("Wire handshake from %s fail", conn.RemoteAddr().String()))
+		return
+	}
+	infoHash, peerId, err := decodeHandshake(msg.payload)
+	if err != nil {
+		log.Err(fmt.Sprintf("Wire handshake from %s fail, %s", conn.RemoteAddr().String(), err.Error()))
+		return
+	}
+	ftMgr := wireFilesMgr.GetTask(infoHash)
+	if ftMgr == nil {
+		log.Err(fmt.Sprintf("Wire handshake from %s fail, task not exist, %s",
+			conn.RemoteAddr().String(),
+			infoHash))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := &wireSession{wireConn: wireConn{conn: conn},
+		ftMgr:     ftMgr,
+		infoHash:  infoHash,
+		peerId:    peerId,
+		requests:  make(chan wireRequest, WIRE_MAX_PENDING),
+		cancelled: make(map[wireRequest]int),
+		ctx:       ctx}
+	if err := session.send(MSG_HANDSHAKE, encodeHandshake(infoHash, setting.AppSetting.GetPeerId())); err != nil {
+		return
+	}
+	log.Info(fmt.Sprintf("Wire connect %s from %s[%s]", infoHash, peerId, conn.RemoteAddr().String()))
+
+	go session.sendHaves()
+	go session.serveRequests()
+
+	err = session.readLoop()
+	log.Info(fmt.Sprintf("Wire disconnect %s from %s, %v", infoHash, peerId, err))
+}
+
+/*
+ * 接收请求方的消息，连接断开时返回
+ */
+func (ws *wireSession) readLoop() error {
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(WIRE_IDLE_TIMEOUT * time.Second))
+		msg, err := readMsg(ws.conn)
+		if err != nil {
+			return err
+		}
+
+		switch msg.id {
+		case MSG_REQUEST:
+			req, err := decodeRequest(msg.payload)
+			if err != nil {
+				return err
+			}
+			if req.length == 0 || req.length > WIRE_MAX_REQUEST {
+				return errors.New(fmt.Sprintf("request length err, %d", req.length))
+			}
+			select {
+			case ws.requests <- req:
+			default:
+				// 等待处理的请求过多
+				if err := ws.reject(req, REJECT_BUSY, 1); err != nil {
+					return err
+				}
+			}
+		case MSG_CANCEL:
+			req, err := decodeRequest(msg.payload)
+			if err != nil {
+				return err
+			}
+			ws.lock.Lock()
+			if len(ws.cancelled) < WIRE_MAX_PENDING {
+				ws.cancelled[req]++
+			}
+			ws.lock.Unlock()
+		case MSG_HANDSHAKE:
+			return errors.New("duplicate handshake")
+		}
+	}
+}
+
+/*
+ * 请求已经取消
+ */
+func (ws *wireSession) isCancelled(req wireRequest) bool {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	if ws.cancelled[req] > 0 {
+		ws.cancelled[req]--
+		if ws.cancelled[req] == 0 {
+			delete(ws.cancelled, req)
+		}
+		return true
+	}
+	return false
+}
+
+/*
+ * 按顺序处理请求
+ */
+func (ws *wireSession) serveRequests() {
+	for {
+		select {
+		case req := <-ws.requests:
+			if ws.isCancelled(req) {
+				continue
+			}
+			if err := ws.serveRequest(req); err != nil {
+				ws.conn.Close()
+				return
+			}
+		case <-ws.ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+ * 处理一个请求，与 http 的 /api/resource/block 检查相同
+ * 发送失败时返回错误，拒绝请求不返回错误
+ */
+func (ws *wireSession) serveRequest(req wireRequest) error {
+	log := logger.NewAgent()
+	defer log.EndLog()
+
+	if wireFilesMgr.IsUploadPaused() {
+		return ws.reject(req, REJECT_BUSY, TIME_SCHEDULE_INTERVAL)
+	}
+	index := int(req.index)
+	blockLength, _, err := ws.ftMgr.GetBlockInfo(index)
+	if err != nil || uint64(req.offset)+uint64(req.length) > uint64(blockLength) {
+		return ws.reject(req, REJECT_NOT_FOUND, 0)
+	}
+	if !ws.ftMgr.RequestUpload(ws.peerId) {
+		return ws.reject(req, REJECT_BUSY, CHOKE_INTERVAL)
+	}
+
+	data, release, err := ws.ftMgr.ReadBlock(index, int(req.offset), int(req.length))
+	switch err {
+	case nil:
+	case ErrUploadBusy:
+		return ws.reject(req, REJECT_BUSY, 1)
+	case ErrBlockNotFound, ErrInvalidRange:
+		return ws.reject(req, REJECT_NOT_FOUND, 0)
+	default:
+		log.Err(fmt.Sprintf("Read block %s[%d] fail, %s", ws.infoHash, index, err.Error()))
+		return ws.reject(req, REJECT_NOT_FOUND, 0)
+	}
+	defer release()
+
+	// 上传限速，发送前等待
+	for _, limiter := range ws.ftMgr.uploadLimiters() {
+		if err := limiter.Wait(ws.ctx, len(data)); err != nil {
+			return err
+		}
+	}
+	if ws.isCancelled(req) {
+		return nil
+	}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:], req.index)
+	binary.BigEndian.PutUint32(header[4:], req.offset)
+	if err := ws.send(MSG_PIECE, header, data); err != nil {
+		log.Err(fmt.Sprintf("Send block %s[%d] to %s fail, %s", ws.infoHash, index, ws.peerId, err.Error()))
+		return err
+	}
+	ws.ftMgr.AddUpload(int64(len(data)))
+	log.Info(fmt.Sprintf("Send block %s[%d] to %s by wire, range: %d-%d",
+		ws.infoHash,
+		index,
+		ws.peerId,
+		req.offset,
+		req.offset+req.length-1))
+	return nil
+}
+
+/*
+ * 发送 bitfield，之后发送新完成的块，空闲时发送 keep-alive
+ * 任务重新开始或者序号过期时重新发送 bitfield
+ */
+func (ws *wireSession) sendHaves() {
+	defer ws.conn.Close()
+
+	var haves *HaveLog
+	var seq int64
+	for ws.ctx.Err() == nil {
+		// 任务没有开始时等待
+		var bits []byte
+		var err error
+		current := ws.ftMgr.getHaveLog()
+		if current != nil && current != haves {
+			bits, _, seq, err = ws.ftMgr.GetBitfield()
+		}
+		if current == nil || err != nil {
+			haves = nil
+			select {
+			case <-time.After(WIRE_KEEPALIVE_INTERVAL * time.Second):
+			case <-ws.ctx.Done():
+				return
+			}
+			if ws.send(MSG_KEEPALIVE) != nil {
+				return
+			}
+			continue
+		}
+		if current != haves {
+			if ws.send(MSG_BITFIELD, bits) != nil {
+				return
+			}
+			haves = current
+		}
+
+		blocks, newSeq, ok := haves.Wait(ws.ctx, seq, WIRE_KEEPALIVE_INTERVAL*time.Second)
+		if ws.ctx.Err() != nil {
+			return
+		}
+		if !ok {
+			haves = nil
+			continue
+		}
+		seq = newSeq
+		if len(blocks) == 0 {
+			if ws.send(MSG_KEEPALIVE) != nil {
+				return
+			}
+			continue
+		}
+		for _, index := range blocks {
+			buf := make([]byte, 4)
+			binary.BigEndian.PutUint32(buf, uint32(index))
+			if ws.send(MSG_HAVE, buf) != nil {
+				return
+			}
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/blueskyz/uvdt/logger"
 	"github.com/blueskyz/uvdt/node-tool"
@@ -39,6 +40,16 @@ func ParseCmd() error {
 		"",
 		"add a shared resource file")
 
+	// 资源目录下的每个子目录创建一个多文件种子
+	multiFile := flag.Bool("multifile",
+		false,
+		"create a multifile torrent for each directory in resource path")
+
+	// web seed 地址，多个地址用逗号分隔，以 / 结尾的地址为目录
+	webSeeds := flag.String("webseeds",
+		"",
+		"origin http urls embedded in torrent, separated by comma")
+
 	// tracker 服务器的地址
 	trackerServ := flag.String("trackerserv",
 		"0.0.0.0:30081",
@@ -54,6 +65,8 @@ func ParseCmd() error {
 	log.Printf("add a shared resource path: %s", *resPath)
 	log.Printf("add a shared resource file: %s", *resFile)
 	log.Printf("add a shared torrent file path: %s", *torrentPath)
+	log.Printf("multifile torrent: %v", *multiFile)
+	log.Printf("web seeds: %s", *webSeeds)
 	log.Printf("tracker server ip port: %s", *trackerServ)
 	log.Printf("log file: %s", *logFile)
 
@@ -89,6 +102,17 @@ func ParseCmd() error {
 		return errors.New("both resource path and resource file are empty")
 	}
 
+	AppSetting.SetMultiFile(*multiFile)
+	if len(*webSeeds) > 0 {
+		seeds := []string{}
+		for _, v := range strings.Split(*webSeeds, ",") {
+			if v = strings.TrimSpace(v); len(v) > 0 {
+				seeds = append(seeds, v)
+			}
+		}
+		AppSetting.SetWebSeeds(seeds)
+	}
+
 	if len(*torrentPath) == 0 {
 		log.Printf("torrent file path is empty")
 	} else {
@@ -15,6 +15,9 @@ import (
 	// "time"
 )
 
+// 分片大小 2MB
+const FILE_CHUNK = 1 * (1 << 21)
+
 type CreatorTorrent struct {
 }
 
@@ -72,6 +75,9 @@ func (creator *CreatorTorrent) ScanPath() ([]string, error) {
 				c["mtime"] = fileInfo.ModTime().UnixNano()
 				c["part_count"] = len(partsMd5)
 				c["file_parts"] = partsMd5
+				if webSeeds := appSetting.GetWebSeeds(); len(webSeeds) > 0 {
+					c["web_seeds"] = webSeeds
+				}
 				torrent, err := json.Marshal(c)
 				if err != nil {
 					return []string{}, err
@@ -88,12 +94,138 @@ func (creator *CreatorTorrent) ScanPath() ([]string, error) {
 				defer f.Close()
 
 				f.Write(torrent)
+			} else if appSetting.GetMultiFile() {
+				if err := creator.createDirTorrent(torrentPath, fileInfo.Name()); err != nil {
+					return []string{}, err
+				}
 			}
 		}
 	}
 	return []string{}, nil
 }
 
+/*
+ * 为目录创建多文件种子
+ * 目录下的所有文件按路径排序后连接成一个数据流，分片可以跨越文件边界
+ */
+func (creator *CreatorTorrent) createDirTorrent(torrentPath string, dirName string) error {
+	appSetting := &setting.AppSetting
+	dirPath := path.Join(appSetting.GetAbResPath(), dirName)
+
+	fileSize, fileMd5, partsMd5, files, err := creator.calcDirMd5(dirPath)
+	if err != nil {
+		return err
+	}
+	if fileSize == 0 {
+		log.Printf("%s is empty, skip", dirPath)
+		return nil
+	}
+
+	c := make(map[string]interface{})
+	c["version"] = "1.0"
+	c["contenttype"] = "multifile"
+	c["block_size"] = FILE_CHUNK
+	c["file_path"] = appSetting.GetResPath()
+	c["file_name"] = dirName
+	c["file_size"] = fileSize
+	c["file_md5"] = fileMd5
+	c["part_count"] = len(partsMd5)
+	c["file_parts"] = partsMd5
+	c["files"] = files
+	if webSeeds := appSetting.GetWebSeeds(); len(webSeeds) > 0 {
+		c["web_seeds"] = webSeeds
+	}
+	torrent, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s", torrent)
+
+	// 保存 torrent 文件
+	torrentFile := path.Join(torrentPath, dirName) + "." + fileMd5
+	f, err := os.OpenFile(torrentFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(torrent)
+	return err
+}
+
+/*
+ * 计算目录下所有文件连接成的数据流的 md5 和分片 md5
+ * 返回数据大小，md5，分片 md5，文件列表: [{"path": "a/b.txt", "size": 1024}]
+ */
+func (creator *CreatorTorrent) calcDirMd5(dirPath string) (int64,
+	string,
+	[]string,
+	[]map[string]interface{},
+	error) {
+
+	// filepath.Walk 按字典序遍历，保证文件顺序固定
+	files := []map[string]interface{}{}
+	err := filepath.Walk(dirPath, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, map[string]interface{}{
+			"path": filepath.ToSlash(relPath),
+			"size": fileInfo.Size()})
+		return nil
+	})
+	if err != nil {
+		return 0, "", nil, nil, err
+	}
+
+	h := md5.New()
+	partsMd5 := []string{}
+	partBuffer := make([]byte, FILE_CHUNK)
+	partSize := 0
+	fileSize := int64(0)
+	for _, v := range files {
+		f, err := os.Open(path.Join(dirPath, v["path"].(string)))
+		if err != nil {
+			return 0, "", nil, nil, err
+		}
+		readSize := int64(0)
+		for {
+			n, err := io.ReadFull(f, partBuffer[partSize:])
+			partSize += n
+			readSize += int64(n)
+			if partSize == FILE_CHUNK {
+				h.Write(partBuffer)
+				partsMd5 = append(partsMd5, fmt.Sprintf("%x", md5.Sum(partBuffer)))
+				partSize = 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return 0, "", nil, nil, err
+			}
+		}
+		f.Close()
+
+		// 以读取的数据为准，避免扫描后文件被修改
+		v["size"] = readSize
+		fileSize += readSize
+	}
+	if partSize > 0 {
+		h.Write(partBuffer[:partSize])
+		partsMd5 = append(partsMd5, fmt.Sprintf("%x", md5.Sum(partBuffer[:partSize])))
+	}
+
+	return fileSize, fmt.Sprintf("%x", h.Sum(nil)), partsMd5, files, nil
+}
+
 func (creator *CreatorTorrent) calcFileMd5(filePath string) (int, string,
 	[]string,
 	error) {
@@ -113,7 +245,7 @@ func (creator *CreatorTorrent) calcFileMd5(filePath string) (int, string,
 	f.Seek(0, os.SEEK_SET)
 	fileInfo, _ := f.Stat()
 	fileSize := fileInfo.Size()
-	const fileChunk = 1 * (1 << 21)
+	const fileChunk = FILE_CHUNK
 	floatChunk := float64(fileSize) / float64(fileChunk)
 	totalPartsNum := uint64(math.Ceil(floatChunk))
 	partsMd5 := []string{}
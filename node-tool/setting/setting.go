@@ -24,8 +24,10 @@ type Setting struct {
 	logFile  string
 	rootPath string // 上传，下载的资源文件路径
 
-	resPath string
-	resFile string
+	resPath   string
+	resFile   string
+	multiFile bool     // 资源目录下的子目录创建为多文件种子
+	webSeeds  []string // 种子中的 web seed 地址
 
 	torrentPath string
 
@@ -85,6 +87,24 @@ func (set *Setting) GetResFile() string {
 	return set.resFile
 }
 
+// 设置是否为子目录创建多文件种子
+func (set *Setting) SetMultiFile(multiFile bool) {
+	set.multiFile = multiFile
+}
+
+func (set *Setting) GetMultiFile() bool {
+	return set.multiFile
+}
+
+// 设置 web seed 地址，没有 peer 时 node 从这些 http 服务器下载
+func (set *Setting) SetWebSeeds(webSeeds []string) {
+	set.webSeeds = webSeeds
+}
+
+func (set *Setting) GetWebSeeds() []string {
+	return set.webSeeds
+}
+
 // 设置 trace server
 func (set *Setting) SetTraceServ(value string) error {
 	trackerServ, err := str2Serv(value)
@@ -33,6 +33,14 @@ func ParseCmd() error {
 		"0.0.0.0:8089",
 		"bt server's ip and port")
 
+	// bt 客户端之间的 tcp 长连接接口，为空时不启动
+	wireServ := flag.String("wireserv",
+		"",
+		"bt wire server's ip and port, e.g. 0.0.0.0:8090, empty: disabled")
+	transport := flag.String("transport",
+		setting.AppSetting.GetTransport(),
+		"download transport, wire: use wire when the peer supports it, http: http only")
+
 	// tracker 服务器的地址
 	trackerServ := flag.String("trackerserv",
 		"0.0.0.0:30081",
@@ -41,13 +49,53 @@ func ParseCmd() error {
 		"/var/log/uvdt-node.log",
 		"log file")
 
+	// 同时下载的任务数量，超过的任务排队等待
+	maxFileNum := flag.Uint("maxfilenum",
+		setting.AppSetting.GetMaxFileNum(),
+		"max number of tasks downloading at the same time")
+
+	// 限速，单位：KB/s，0: 不限速
+	downloadRate := flag.Int("downloadrate",
+		0,
+		"node download rate limit, KB/s, 0: unlimited")
+	uploadRate := flag.Int("uploadrate",
+		0,
+		"node upload rate limit, KB/s, 0: unlimited")
+	taskDownloadRate := flag.Int("taskdownloadrate",
+		0,
+		"download rate limit for each task, KB/s, 0: unlimited")
+	taskUploadRate := flag.Int("taskuploadrate",
+		0,
+		"upload rate limit for each task, KB/s, 0: unlimited")
+
+	// 时间表文件，每周的时间段设置限速，或者暂停下载和上传
+	scheduleFile := flag.String("schedule",
+		"",
+		"weekly transfer schedule file, json")
+
+	// 同时上传的 peer 数量，超过时拒绝请求，定时轮换
+	uploadSlots := flag.Int("uploadslots",
+		setting.AppSetting.GetUploadSlots(),
+		"upload slots for each task, 0: unlimited")
+	nodeUploadSlots := flag.Int("nodeuploadslots",
+		setting.AppSetting.GetNodeUploadSlots(),
+		"upload slots for the node, 0: unlimited")
+
 	flag.Parse()
 
 	// 打印服务参数
 	log.Printf("http server ip port: %s", *httpServ)
 	log.Printf("bt server ip port: %s", *btServ)
+	log.Printf("bt wire server ip port: %s, transport: %s", *wireServ, *transport)
 	log.Printf("tracker server ip port: %s", *trackerServ)
 	log.Printf("log file: %s", *logFile)
+	log.Printf("max file num: %d", *maxFileNum)
+	log.Printf("download rate: %d KB/s, upload rate: %d KB/s", *downloadRate, *uploadRate)
+	log.Printf("task download rate: %d KB/s, task upload rate: %d KB/s",
+		*taskDownloadRate,
+		*taskUploadRate)
+	log.Printf("schedule file: %s", *scheduleFile)
+	log.Printf("upload slots: %d, node upload slots: %d", *uploadSlots, *nodeUploadSlots)
 
 	// 创建配置对象
 	AppSetting := &setting.AppSetting
@@ -58,10 +106,24 @@ func ParseCmd() error {
 	}
 
 	AppSetting.SetLogFile(*logFile)
+	AppSetting.SetMaxFileNum(*maxFileNum)
+	AppSetting.SetDownloadRate(*downloadRate)
+	AppSetting.SetUploadRate(*uploadRate)
+	AppSetting.SetTaskDownloadRate(*taskDownloadRate)
+	AppSetting.SetTaskUploadRate(*taskUploadRate)
+	AppSetting.SetScheduleFile(*scheduleFile)
+	AppSetting.SetUploadSlots(*uploadSlots)
+	AppSetting.SetNodeUploadSlots(*nodeUploadSlots)
 	err := AppSetting.SetHttpServ(*httpServ)
 	if err == nil {
 		err = AppSetting.SetBtServ(*btServ)
 	}
+	if err == nil {
+		err = AppSetting.SetWireServ(*wireServ)
+	}
+	if err == nil {
+		err = AppSetting.SetTransport(*transport)
+	}
 	if err == nil {
 		err = AppSetting.SetTraceServ(*trackerServ)
 	}
@@ -104,6 +166,7 @@ func main() {
 
 	// 启动资源分享服务器
 	go nodeserv.BtHttpServ(filesMgr)
+	go nodeserv.WireServ(filesMgr)
 
 	// 启动管理服务器
 	err = nodeserv.HttpServ(filesMgr)